@@ -0,0 +1,83 @@
+package apis
+
+import (
+	"strconv"
+
+	"keyboard-api/images"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// parseImageOptions reads the query parameters shared by the endpoints that
+// render images for the device's display.
+func parseImageOptions(c echo.Context) (options images.Options, err error) {
+	options.Format, err = images.ParsePixelFormat(c.QueryParam("format"))
+	if err != nil {
+		return options, apis.NewBadRequestError("format must be one of bmp, rgb565be, rgb565le, rgb888, bgr888, mono, gray2 or gray4", nil)
+	}
+
+	options.Fit, err = images.ParseFitMode(c.QueryParam("fit"))
+	if err != nil {
+		return options, apis.NewBadRequestError("fit must be one of cover, contain or stretch", nil)
+	}
+
+	options.Anchor, err = images.ParseAnchor(c.QueryParam("anchor"))
+	if err != nil {
+		return options, apis.NewBadRequestError("anchor must be center, top, bottom, left, right, a corner like top-left or smart", nil)
+	}
+
+	backgroundRaw := c.QueryParam("background")
+	if backgroundRaw != "" {
+		options.Background, err = images.ParseColor(backgroundRaw)
+		if err != nil {
+			return options, apis.NewBadRequestError("background must be a hex color like ff8800", nil)
+		}
+	}
+
+	rotateRaw := c.QueryParam("rotate")
+	if rotateRaw != "" {
+		options.Rotate, err = strconv.Atoi(rotateRaw)
+		if err != nil || options.Rotate%90 != 0 || options.Rotate < 0 || options.Rotate >= 360 {
+			return options, apis.NewBadRequestError("rotate must be 0, 90, 180 or 270", nil)
+		}
+	}
+
+	switch c.QueryParam("mirror") {
+	case "":
+	case "horizontal":
+		options.MirrorHorizontal = true
+	case "vertical":
+		options.MirrorVertical = true
+	case "both":
+		options.MirrorHorizontal = true
+		options.MirrorVertical = true
+	default:
+		return options, apis.NewBadRequestError("mirror must be horizontal, vertical or both", nil)
+	}
+
+	options.Dither, err = images.ParseDitherMode(c.QueryParam("dither"))
+	if err != nil {
+		return options, apis.NewBadRequestError("dither must be one of floyd-steinberg, atkinson, bayer or threshold", nil)
+	}
+
+	thresholdRaw := c.QueryParam("threshold")
+	if thresholdRaw != "" {
+		options.Threshold, err = strconv.Atoi(thresholdRaw)
+		if err != nil || options.Threshold < 1 || options.Threshold > 255 {
+			return options, apis.NewBadRequestError("threshold must be a number between 1 and 255", nil)
+		}
+	}
+
+	options.Packing, err = images.ParseMonoPacking(c.QueryParam("packing"))
+	if err != nil {
+		return options, apis.NewBadRequestError("packing must be rows or pages", nil)
+	}
+
+	options.NibbleOrder, err = images.ParseNibbleOrder(c.QueryParam("nibbleOrder"))
+	if err != nil {
+		return options, apis.NewBadRequestError("nibbleOrder must be msb or lsb", nil)
+	}
+
+	return options, nil
+}
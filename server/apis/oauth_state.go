@@ -0,0 +1,135 @@
+package apis
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+)
+
+const (
+	SPOTIFY_OAUTH_STATE_TTL_MS = 10 * 60 * 1000
+)
+
+// OauthState is passed through the spotify authorization flow to tie the
+// callback back to the user who started it. It is signed by the server and its
+// nonce can only be redeemed once. Pending nonces are only kept in memory, so
+// restarting the server invalidates every login link that was not used yet.
+type OauthState struct {
+	UserId    string `json:"user_id"`
+	Nonce     string `json:"nonce"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (client *SpotifyClient) getStateSecret() []byte {
+	client.stateSecretOnce.Do(func() {
+		if len(client.StateSecret) > 0 {
+			return
+		}
+		// pending nonces do not survive a restart either, see OauthState
+		client.StateSecret = make([]byte, 32)
+		rand.Read(client.StateSecret)
+	})
+	return client.StateSecret
+}
+
+func (client *SpotifyClient) signState(payload string) string {
+	mac := hmac.New(sha256.New, client.getStateSecret())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueOauthState returns a signed state token for the user and remembers its
+// nonce until it is redeemed or expires.
+func (client *SpotifyClient) issueOauthState(userId string) (string, error) {
+	nonceBytes := make([]byte, 16)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return "", err
+	}
+
+	state := OauthState{
+		UserId:    userId,
+		Nonce:     hex.EncodeToString(nonceBytes),
+		ExpiresAt: time.Now().UnixMilli() + SPOTIFY_OAUTH_STATE_TTL_MS,
+	}
+
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+
+	client.noncesMu.Lock()
+	defer client.noncesMu.Unlock()
+
+	if client.pendingNonces == nil {
+		client.pendingNonces = map[string]int64{}
+	}
+	now := time.Now().UnixMilli()
+	for nonce, expiresAt := range client.pendingNonces {
+		if expiresAt < now {
+			delete(client.pendingNonces, nonce)
+		}
+	}
+	client.pendingNonces[state.Nonce] = state.ExpiresAt
+
+	payload := base64.RawURLEncoding.EncodeToString(stateBytes)
+	return payload + "." + client.signState(payload), nil
+}
+
+// redeemOauthState verifies the signature and expiry of a state token and
+// consumes its nonce, so a state can not be replayed.
+func (client *SpotifyClient) redeemOauthState(token string) (state OauthState, err error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return state, errors.New("malformed state")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(client.signState(payload))) {
+		return state, errors.New("invalid state signature")
+	}
+
+	stateBytes, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return state, errors.New("malformed state")
+	}
+	err = json.Unmarshal(stateBytes, &state)
+	if err != nil {
+		return state, errors.New("malformed state")
+	}
+
+	if state.ExpiresAt < time.Now().UnixMilli() {
+		return state, errors.New("state expired")
+	}
+
+	client.noncesMu.Lock()
+	defer client.noncesMu.Unlock()
+
+	if _, ok := client.pendingNonces[state.Nonce]; !ok {
+		return state, errors.New("state already used")
+	}
+	delete(client.pendingNonces, state.Nonce)
+
+	return state, nil
+}
+
+func oauthErrorPage(c echo.Context, message string) error {
+	return c.HTML(400, fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head><title>Could not connect Spotify</title></head>
+<body>
+<h1>Could not connect Spotify</h1>
+<p>%s</p>
+<p>Please start linking your Spotify account again from your device.</p>
+</body>
+</html>`, html.EscapeString(message)))
+}
@@ -2,17 +2,16 @@ package apis
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	"io"
 	"keyboard-api/images"
+	"keyboard-api/secrets"
 	"keyboard-api/utils"
-	"net/http"
+	"log"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -21,18 +20,13 @@ import (
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/models"
-	"github.com/pocketbase/pocketbase/tools/types"
 )
 
 const (
-	SCOPES                          = "user-read-playback-state user-read-currently-playing user-modify-playback-state user-library-read"
+	SCOPES                          = "user-read-playback-state user-read-currently-playing user-modify-playback-state user-library-read user-library-modify user-read-recently-played"
 	SPOTIFY_TOKEN_REFRESH_BUFFER_MS = 5000
 )
 
-type OauthState struct {
-	UserId string `json:"user_id"`
-}
-
 type SpotifyCredentials struct {
 	AccessToken  string `json:"access_token"`
 	TokenType    string `json:"token_type"`
@@ -40,49 +34,51 @@ type SpotifyCredentials struct {
 	ExpiresAt    int64  `json:"expires_at"`
 	Scope        string `json:"scope"`
 	RefreshToken string `json:"refresh_token"`
+	// set when spotify rejected the refresh token, the user has to log in again
+	NeedsReauth bool `json:"needs_reauth,omitempty"`
 }
 
-func SpotifyLoginUrlHandler(c echo.Context) error {
-	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
-
-	if record == nil {
-		return apis.NewForbiddenError("You must be logged in", nil)
-	}
+func SpotifyLoginUrlHandler(client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
 
-	state := OauthState{
-		UserId: record.Id,
-	}
+		if record == nil {
+			return apis.NewForbiddenError("You must be logged in", nil)
+		}
 
-	stateStr, _ := json.Marshal(state)
+		state, err := client.issueOauthState(record.Id)
+		if err != nil {
+			return err
+		}
 
-	url := fmt.Sprintf("https://accounts.spotify.com/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=%s&state=%s", url.QueryEscape(os.Getenv("SPOTIFY_CLIENT_ID")), url.QueryEscape(utils.ServerURL("/spotify/callback")), url.QueryEscape(SCOPES), url.QueryEscape(string(stateStr)))
+		url := client.authorizeUrl(utils.ServerURL("/spotify/callback"), SCOPES, state)
 
-	return c.JSON(200, struct {
-		Url string `json:"url"`
-	}{
-		Url: url,
-	})
+		return c.JSON(200, struct {
+			Url string `json:"url"`
+		}{
+			Url: url,
+		})
+	}
 }
 
-func SpotifyCallbackHandler(app *pocketbase.PocketBase) func(c echo.Context) error {
+func SpotifyCallbackHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
 	return func(c echo.Context) error {
 		code := c.QueryParam("code")
 		state := c.QueryParam("state")
 		errQuery := c.QueryParam("error")
 
 		if errQuery != "" {
-			return apis.NewBadRequestError("Error during authentication", nil)
+			return oauthErrorPage(c, "Spotify reported an error during authentication: "+errQuery)
 		}
 
-		oauthState := OauthState{}
-		err := json.Unmarshal([]byte(state), &oauthState)
+		oauthState, err := client.redeemOauthState(state)
 		if err != nil {
-			return apis.NewBadRequestError("Invalid state", nil)
+			return oauthErrorPage(c, "This login link is invalid or has expired ("+err.Error()+").")
 		}
 
 		user, err := app.Dao().FindRecordById("users", oauthState.UserId)
 		if err != nil {
-			return apis.NewBadRequestError("Could not find user", nil)
+			return oauthErrorPage(c, "The account that started this login no longer exists.")
 		}
 
 		payload := url.Values{}
@@ -90,27 +86,19 @@ func SpotifyCallbackHandler(app *pocketbase.PocketBase) func(c echo.Context) err
 		payload.Set("code", code)
 		payload.Set("redirect_uri", utils.ServerURL("/spotify/callback"))
 
-		req, _ := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(payload.Encode()))
-
-		authorizationToken := base64.StdEncoding.EncodeToString([]byte(os.Getenv("SPOTIFY_CLIENT_ID") + ":" + os.Getenv("SPOTIFY_CLIENT_SECRET")))
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-		req.Header.Add("Authorization", fmt.Sprintf("Basic %s", authorizationToken))
-
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-
-		body, err := io.ReadAll(resp.Body)
+		_, body, err := client.tokenRequest(payload)
 		if err != nil {
 			return err
 		}
 
 		bodyStr := string(body)
 
-		_, err = saveSpotifyCredentials(app, user, bodyStr)
+		_, err = client.saveCredentials(app, user, bodyStr)
 
+		if errors.Is(err, secrets.ErrNoKey) {
+			log.Println(err)
+			return apis.NewApiError(500, "The server can not store spotify credentials, CREDENTIALS_KEY is not configured", nil)
+		}
 		if err != nil {
 			return apis.NewBadRequestError("Failed to exchange code for token", nil)
 		}
@@ -119,7 +107,13 @@ func SpotifyCallbackHandler(app *pocketbase.PocketBase) func(c echo.Context) err
 	}
 }
 
-func saveSpotifyCredentials(app *pocketbase.PocketBase, user *models.Record, credsStr string) (accessToken string, err error) {
+// isUsable reports whether the access token can still be used for a request,
+// leaving a buffer so it does not expire while the request is in flight.
+func (creds *SpotifyCredentials) isUsable() bool {
+	return creds.AccessToken != "" && creds.ExpiresAt-SPOTIFY_TOKEN_REFRESH_BUFFER_MS > time.Now().UnixMilli()
+}
+
+func (client *SpotifyClient) saveCredentials(app *pocketbase.PocketBase, user *models.Record, credsStr string) (accessToken string, err error) {
 	token := struct {
 		AccessToken  string `json:"access_token"`
 		TokenType    string `json:"token_type"`
@@ -128,7 +122,7 @@ func saveSpotifyCredentials(app *pocketbase.PocketBase, user *models.Record, cre
 		RefreshToken string `json:"refresh_token"`
 	}{}
 	err = json.Unmarshal([]byte(credsStr), &token)
-	if err != nil {
+	if err != nil || token.AccessToken == "" {
 		return "", errors.New("invalid response")
 	}
 
@@ -138,92 +132,105 @@ func saveSpotifyCredentials(app *pocketbase.PocketBase, user *models.Record, cre
 		Scope:        token.Scope,
 		RefreshToken: token.RefreshToken,
 		ExpiresIn:    token.ExpiresIn,
-		ExpiresAt:    time.Now().UnixMilli() + token.ExpiresIn,
+		// expires_in is in seconds
+		ExpiresAt: time.Now().UnixMilli() + token.ExpiresIn*1000,
 	}
 
 	if creds.RefreshToken == "" {
-		var existingCreds SpotifyCredentials
-		existingCredsRaw := user.Get("spotify").(types.JsonRaw)
-		err = json.Unmarshal(existingCredsRaw, &existingCreds)
-
+		existingCreds, err := ReadSpotifyCredentials(user)
 		if err != nil {
 			return "", err
 		}
 		creds.RefreshToken = existingCreds.RefreshToken
 	}
 
-	user.Set("spotify", creds)
-	app.Dao().SaveRecord(user)
-
-	return creds.AccessToken, nil
-}
-
-func refreshSpotifyToken(app *pocketbase.PocketBase, userId string) (token string, err error) {
-
-	user, err := app.Dao().FindRecordById("users", userId)
+	err = WriteSpotifyCredentials(user, creds)
 	if err != nil {
-		return "", errors.New("could not find user")
-	}
-
-	creds := user.Get("spotify").(types.JsonRaw)
-	if creds == nil {
-		return "", errors.New("could not find spotify credentials")
+		return "", err
 	}
-
-	var spotify SpotifyCredentials
-	err = json.Unmarshal(creds, &spotify)
+	err = app.Dao().SaveRecord(user)
 	if err != nil {
 		return "", err
 	}
 
-	if spotify.ExpiresAt > time.Now().UnixMilli()-SPOTIFY_TOKEN_REFRESH_BUFFER_MS {
-		return spotify.AccessToken, nil
-	}
+	client.tokenCache.Store(user.Id, creds)
+
+	return creds.AccessToken, nil
+}
+
+// refreshToken exchanges the stored refresh token for a new access token.
+// Concurrent refreshes for the same user share one request to spotify, and the
+// record is re-read first in case another request already refreshed it. A stored
+// token equal to rejectedToken is refreshed even if it has not expired yet.
+func (client *SpotifyClient) refreshToken(app *pocketbase.PocketBase, userId, rejectedToken string) (token string, err error) {
+	result, err, _ := client.refreshGroup.Do(userId, func() (any, error) {
+		user, err := app.Dao().FindRecordById("users", userId)
+		if err != nil {
+			return "", errors.New("could not find user")
+		}
 
-	payload := url.Values{}
-	payload.Set("grant_type", "refresh_token")
-	payload.Set("refresh_token", spotify.RefreshToken)
+		spotify, err := ReadSpotifyCredentials(user)
+		if err != nil {
+			return "", err
+		}
 
-	req, _ := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(payload.Encode()))
+		if spotify.NeedsReauth {
+			return "", ErrSpotifyReconnectRequired
+		}
 
-	authorizationToken := base64.StdEncoding.EncodeToString([]byte(os.Getenv("SPOTIFY_CLIENT_ID") + ":" + os.Getenv("SPOTIFY_CLIENT_SECRET")))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", authorizationToken))
+		if spotify.isUsable() && spotify.AccessToken != rejectedToken {
+			client.tokenCache.Store(userId, spotify)
+			return spotify.AccessToken, nil
+		}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
+		payload := url.Values{}
+		payload.Set("grant_type", "refresh_token")
+		payload.Set("refresh_token", spotify.RefreshToken)
+
+		statusCode, body, err := client.tokenRequest(payload)
+		if err != nil {
+			return "", err
+		}
 
-	defer resp.Body.Close()
+		if statusCode == 400 && isInvalidGrant(body) {
+			return "", client.markNeedsReauth(app, user, spotify)
+		}
 
-	body, err := io.ReadAll(resp.Body)
+		bodyStr := string(body)
+		return client.saveCredentials(app, user, bodyStr)
+	})
 	if err != nil {
 		return "", err
 	}
 
-	bodyStr := string(body)
-	return saveSpotifyCredentials(app, user, bodyStr)
-
+	return result.(string), nil
 }
 
-func getSpotifyToken(app *pocketbase.PocketBase, user *models.Record) (token string, err error) {
-	creds := user.Get("spotify").(types.JsonRaw)
-	if creds == nil {
-		return "", errors.New("could not find spotify credentials")
+// getToken returns a usable access token for the user, preferring the in-memory
+// cache over the (possibly stale) record and refreshing only when both expired.
+func (client *SpotifyClient) getToken(app *pocketbase.PocketBase, user *models.Record) (token string, err error) {
+	if cached, ok := client.tokenCache.Load(user.Id); ok {
+		cachedCreds := cached.(SpotifyCredentials)
+		if cachedCreds.isUsable() {
+			return cachedCreds.AccessToken, nil
+		}
 	}
 
-	var spotify SpotifyCredentials
-	err = json.Unmarshal(creds, &spotify)
-
+	spotify, err := ReadSpotifyCredentials(user)
 	if err != nil {
 		return "", err
 	}
 
-	if spotify.ExpiresAt < time.Now().UnixMilli()-SPOTIFY_TOKEN_REFRESH_BUFFER_MS || spotify.AccessToken == "" {
-		return refreshSpotifyToken(app, user.Id)
+	if spotify.NeedsReauth {
+		return "", ErrSpotifyReconnectRequired
+	}
+
+	if !spotify.isUsable() {
+		return client.refreshToken(app, user.Id, "")
 	}
 
+	client.tokenCache.Store(user.Id, spotify)
+
 	return spotify.AccessToken, nil
 }
 
@@ -233,31 +240,81 @@ type SpotifyAlbumImagesResponse struct {
 	Width  int    `json:"width"`
 }
 
-type RawSpotifyCurrentlyPlayingResponse struct {
-	IsPlaying bool `json:"is_playing"`
-	Track     struct {
-		Id         string `json:"id"`
-		Name       string `json:"name"`
-		Popularity int    `json:"popularity"`
-		DurationMs int    `json:"duration_ms"`
-
-		Album struct {
-			Id     string                       `json:"id"`
-			Name   string                       `json:"name"`
-			Images []SpotifyAlbumImagesResponse `json:"images"`
-		}
+type RawSpotifyDevice struct {
+	Id             string `json:"id"`
+	IsActive       bool   `json:"is_active"`
+	IsRestricted   bool   `json:"is_restricted"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	VolumePercent  int    `json:"volume_percent"`
+	SupportsVolume bool   `json:"supports_volume"`
+}
 
-		Artists []struct {
-			Id   string `json:"id"`
-			Name string `json:"name"`
-		}
-	} `json:"item"`
-	CurrentlyPlayingType string `json:"currently_playing_type"`
-	ProgressMs           int    `json:"progress_ms"`
+type SpotifyArtist struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// RawSpotifyItem is a playable item, either a track or a podcast episode
+// depending on Type.
+type RawSpotifyItem struct {
+	Id         string `json:"id"`
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Popularity int    `json:"popularity"`
+	DurationMs int    `json:"duration_ms"`
+
+	// only set for tracks
+	Album struct {
+		Id     string                       `json:"id"`
+		Name   string                       `json:"name"`
+		Images []SpotifyAlbumImagesResponse `json:"images"`
+	}
+
+	Artists []SpotifyArtist
+
+	// only set for episodes
+	Images []SpotifyAlbumImagesResponse `json:"images"`
+	Show   struct {
+		Id        string                       `json:"id"`
+		Name      string                       `json:"name"`
+		Publisher string                       `json:"publisher"`
+		Images    []SpotifyAlbumImagesResponse `json:"images"`
+	} `json:"show"`
+}
+
+func (item *RawSpotifyItem) artImages() []SpotifyAlbumImagesResponse {
+	if item.Type != "episode" {
+		return item.Album.Images
+	}
+	if len(item.Images) > 0 {
+		return item.Images
+	}
+	return item.Show.Images
 }
 
+type RawSpotifyCurrentlyPlayingResponse struct {
+	Device               *RawSpotifyDevice `json:"device"`
+	IsPlaying            bool              `json:"is_playing"`
+	Item                 RawSpotifyItem    `json:"item"`
+	CurrentlyPlayingType string            `json:"currently_playing_type"`
+	ProgressMs           int               `json:"progress_ms"`
+	ShuffleState         bool              `json:"shuffle_state"`
+	RepeatState          string            `json:"repeat_state"`
+
+	// set when spotify reported no active device
+	Idle bool `json:"-"`
+}
+
+// SpotifyCurrentlyPlaying describes the current item. For podcast episodes the
+// album fields hold the show, and the publisher is reported as the only artist.
 type SpotifyCurrentlyPlaying struct {
-	IsPlaying bool `json:"is_playing"`
+	// true when there is no active device, all other fields are empty
+	IsIdle    bool   `json:"is_idle"`
+	IsPlaying bool   `json:"is_playing"`
+	MediaType string `json:"media_type"`
+	// true when spotify is rate limiting and this is the last known state
+	Stale bool `json:"stale"`
 
 	TrackId    string `json:"track_id"`
 	TrackName  string `json:"track_name"`
@@ -270,10 +327,21 @@ type SpotifyCurrentlyPlaying struct {
 	AlbumName   string `json:"album_name"`
 	AlbumArtUrl string `json:"album_art_url"`
 
-	Artists []struct {
-		Id   string `json:"id"`
-		Name string `json:"name"`
-	} `json:"artists"`
+	VolumePercent int    `json:"volume_percent"`
+	IsSaved       bool   `json:"is_saved"`
+	ShuffleState  bool   `json:"shuffle_state"`
+	RepeatState   string `json:"repeat_state"`
+
+	Artists []SpotifyArtist `json:"artists"`
+
+	// unix time in ms at which TrackProgressMs was read from spotify, compare with
+	// ServerTimeMs to advance the progress bar locally without clock sync
+	ProgressSampledAtMs int64 `json:"progress_sampled_at_ms"`
+	ServerTimeMs        int64 `json:"server_time_ms"`
+	// changes only when the item or its art changes
+	StateHash string `json:"state_hash"`
+	// suggested delay before the device polls again
+	NextPollMs int `json:"next_poll_ms"`
 }
 
 func getBestFitSpotifyAlbumArtUrl(imgs []SpotifyAlbumImagesResponse, thumbnailWidth, thumbnailHeight int) string {
@@ -288,7 +356,6 @@ func getBestFitSpotifyAlbumArtUrl(imgs []SpotifyAlbumImagesResponse, thumbnailWi
 
 	// find the smallest image that is larger than the thumbnail
 	for _, img := range imgs {
-		fmt.Printf("checking image: %+v\n", img)
 		if img.Width >= thumbnailWidth && img.Height >= thumbnailHeight {
 			if bestFitImage.Width < img.Width && bestFitImage.Height < img.Height {
 				continue
@@ -300,8 +367,8 @@ func getBestFitSpotifyAlbumArtUrl(imgs []SpotifyAlbumImagesResponse, thumbnailWi
 	return utils.ServerURL(fmt.Sprintf("/spotify/currently-playing-art?url=%s&thumbnailWidth=%d&thumbnailHeight=%d", url.QueryEscape(bestFitImage.Url), thumbnailWidth, thumbnailHeight))
 }
 
-func loadSpotifyAlbumArt(url string, thumbnailWidth, thumbnailHeight int) (albumArtBmp []byte, err error) {
-	imgResponse, err := http.Get(url)
+func (client *SpotifyClient) loadAlbumArt(url string, thumbnailWidth, thumbnailHeight int, options images.Options) (albumArtBmp []byte, err error) {
+	imgResponse, err := client.HttpClient.Get(url)
 
 	if err != nil {
 		return albumArtBmp, err
@@ -319,97 +386,215 @@ func loadSpotifyAlbumArt(url string, thumbnailWidth, thumbnailHeight int) (album
 
 	var b bytes.Buffer
 	writer := io.Writer(&b)
-	images.ToBitmap(img, thumbnailWidth, thumbnailHeight, &writer)
+	err = images.ToBitmap(img, thumbnailWidth, thumbnailHeight, &writer, options)
+	if err != nil {
+		return albumArtBmp, err
+	}
 
 	return b.Bytes(), nil
 }
 
-func SpotifyCurrentlyPlayingHandler(app *pocketbase.PocketBase) func(c echo.Context) error {
-	return func(c echo.Context) error {
+func parseSpotifyThumbnailSize(c echo.Context) (thumbnailWidth, thumbnailHeight int) {
+	thumbnailWidthRaw := c.QueryParam("thumbnailWidth")
+	thumbnailHeightRaw := c.QueryParam("thumbnailHeight")
 
-		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if thumbnailWidthRaw != "" {
+		thumbnailWidth, _ = strconv.Atoi(thumbnailWidthRaw)
+	}
+	if thumbnailHeightRaw != "" {
+		thumbnailHeight, _ = strconv.Atoi(thumbnailHeightRaw)
+	}
 
-		if record == nil {
-			return apis.NewForbiddenError("You must be logged in", nil)
-		}
-		token, err := getSpotifyToken(app, record)
-		if err != nil {
-			return apis.NewBadRequestError("Could not get spotify token", nil)
-		}
+	return thumbnailWidth, thumbnailHeight
+}
 
-		req, _ := http.NewRequest("GET", "https://api.spotify.com/v1/me/player/currently-playing", nil)
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+func (client *SpotifyClient) getTokenForRequest(app *pocketbase.PocketBase, c echo.Context) (token *spotifyToken, err error) {
+	record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
 
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
+	if record == nil {
+		return nil, apis.NewForbiddenError("You must be logged in", nil)
+	}
+	accessToken, err := client.getToken(app, record)
+	if err != nil {
+		return nil, spotifyTokenApiError(err)
+	}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
+	return newSpotifyToken(app, record.Id, accessToken), nil
+}
 
-		bodyStr := string(body)
+// toCurrentlyPlaying maps the track or episode fields of SpotifyCurrentlyPlaying,
+// leaving the player state (progress, volume, shuffle, ...) empty.
+func (item *RawSpotifyItem) toCurrentlyPlaying(thumbnailWidth, thumbnailHeight int) SpotifyCurrentlyPlaying {
+	albumArtUrl := getBestFitSpotifyAlbumArtUrl(item.artImages(), thumbnailWidth, thumbnailHeight)
 
-		var response RawSpotifyCurrentlyPlayingResponse
-		err = json.Unmarshal([]byte(bodyStr), &response)
-		if err != nil {
-			return apis.NewBadRequestError("Could not parse response", nil)
-		}
+	if item.Type == "episode" {
+		return SpotifyCurrentlyPlaying{
+			MediaType: item.Type,
 
-		if response.CurrentlyPlayingType != "track" {
-			return c.JSON(200, SpotifyCurrentlyPlaying{
-				IsPlaying:       response.IsPlaying,
-				TrackId:         "",
-				TrackName:       "",
-				Popularity:      0,
-				TrackLengthMs:   0,
-				TrackProgressMs: 0,
-				AlbumId:         "",
-				AlbumName:       "",
-				AlbumArtUrl:     "",
-				Artists:         nil,
-			})
+			TrackId:       item.Id,
+			TrackName:     item.Name,
+			TrackLengthMs: item.DurationMs,
+
+			AlbumId:   item.Show.Id,
+			AlbumName: item.Show.Name,
+
+			AlbumArtUrl: albumArtUrl,
+
+			Artists: []SpotifyArtist{{Name: item.Show.Publisher}},
 		}
+	}
+
+	return SpotifyCurrentlyPlaying{
+		MediaType: item.Type,
+
+		TrackId:       item.Id,
+		TrackName:     item.Name,
+		Popularity:    item.Popularity,
+		TrackLengthMs: item.DurationMs,
+
+		AlbumId:   item.Album.Id,
+		AlbumName: item.Album.Name,
+
+		AlbumArtUrl: albumArtUrl,
+
+		Artists: item.Artists,
+	}
+}
+
+func (client *SpotifyClient) fetchPlayerState(token *spotifyToken) (response RawSpotifyCurrentlyPlayingResponse, err error) {
+	// without additional_types spotify leaves the item empty for podcast episodes
+	query := url.Values{}
+	query.Set("additional_types", "track,episode")
+
+	statusCode, body, err := client.apiRequest(token, "GET", "/me/player", query, nil)
+	if err != nil {
+		return response, err
+	}
+
+	// spotify answers 204 without a body when there is no active device
+	if statusCode == 204 {
+		response.Idle = true
+		return response, nil
+	}
+	if statusCode != 200 {
+		return response, apis.NewBadRequestError("Could not get spotify player state", nil)
+	}
 
-		thumbnailWidthRaw := c.QueryParam("thumbnailWidth")
-		thumbnailHeightRaw := c.QueryParam("thumbnailHeight")
+	bodyStr := string(body)
+
+	err = json.Unmarshal([]byte(bodyStr), &response)
+	if err != nil {
+		return response, apis.NewBadRequestError("Could not parse response", nil)
+	}
+
+	return response, nil
+}
 
-		thumbnailWidth := 0
-		thumbnailHeight := 0
-		if thumbnailWidthRaw != "" {
-			thumbnailWidth, _ = strconv.Atoi(thumbnailWidthRaw)
+// spotifyPlayerSnapshot is everything needed to build a SpotifyCurrentlyPlaying,
+// independent of the thumbnail size a device asks for.
+type spotifyPlayerSnapshot struct {
+	State     RawSpotifyCurrentlyPlayingResponse
+	IsSaved   bool
+	Stale     bool
+	SampledAt time.Time
+}
+
+func (client *SpotifyClient) fetchPlayerSnapshot(userId string, token *spotifyToken) (snapshot spotifyPlayerSnapshot, err error) {
+	snapshot.State, err = client.fetchPlayerState(token)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.SampledAt = time.Now()
+
+	if snapshot.State.CurrentlyPlayingType == "track" {
+		// the liked state is not worth failing the whole payload for, except that
+		// a rate limit has to reach rateLimitedFetch
+		snapshot.IsSaved, err = client.loadTrackSaved(userId, token, snapshot.State.Item.Id)
+		if _, limited := rateLimitDuration(err); limited {
+			return snapshot, err
 		}
-		if thumbnailHeightRaw != "" {
-			thumbnailHeight, _ = strconv.Atoi(thumbnailHeightRaw)
+		if err != nil {
+			log.Printf("Could not check if track %s is saved: %v\n", snapshot.State.Item.Id, err)
 		}
+	}
 
-		albumArtUrl := getBestFitSpotifyAlbumArtUrl(response.Track.Album.Images, thumbnailWidth, thumbnailHeight)
+	return snapshot, nil
+}
 
-		currentlyPlaying := SpotifyCurrentlyPlaying{
-			IsPlaying: response.IsPlaying,
+func (snapshot *spotifyPlayerSnapshot) toCurrentlyPlaying(thumbnailWidth, thumbnailHeight int) (currentlyPlaying SpotifyCurrentlyPlaying) {
+	response := snapshot.State
 
-			TrackId:         response.Track.Id,
-			TrackName:       response.Track.Name,
-			Popularity:      response.Track.Popularity,
-			TrackLengthMs:   response.Track.DurationMs,
-			TrackProgressMs: response.ProgressMs,
+	volumePercent := 0
+	if response.Device != nil {
+		volumePercent = response.Device.VolumePercent
+	}
 
-			AlbumId:   response.Track.Album.Id,
-			AlbumName: response.Track.Album.Name,
+	if response.CurrentlyPlayingType == "track" || response.CurrentlyPlayingType == "episode" {
+		currentlyPlaying = response.Item.toCurrentlyPlaying(thumbnailWidth, thumbnailHeight)
+		currentlyPlaying.TrackProgressMs = response.ProgressMs
+	}
 
-			AlbumArtUrl: albumArtUrl,
+	currentlyPlaying.IsIdle = response.Idle
+	currentlyPlaying.Stale = snapshot.Stale
+	currentlyPlaying.IsPlaying = response.IsPlaying
+	currentlyPlaying.MediaType = response.CurrentlyPlayingType
+	currentlyPlaying.IsSaved = snapshot.IsSaved
+	currentlyPlaying.VolumePercent = volumePercent
+	currentlyPlaying.ShuffleState = response.ShuffleState
+	currentlyPlaying.RepeatState = response.RepeatState
+	currentlyPlaying.ProgressSampledAtMs = snapshot.SampledAt.UnixMilli()
+	currentlyPlaying.updateHints()
+
+	return currentlyPlaying
+}
+
+// fetchCurrentlyPlaying reads the player state without going through the cache.
+// IsSaved is left false since it would take another request.
+func (client *SpotifyClient) fetchCurrentlyPlaying(token *spotifyToken, thumbnailWidth, thumbnailHeight int) (currentlyPlaying SpotifyCurrentlyPlaying, err error) {
+	state, err := client.fetchPlayerState(token)
+	if err != nil {
+		return currentlyPlaying, err
+	}
+
+	snapshot := spotifyPlayerSnapshot{State: state, SampledAt: time.Now()}
+	return snapshot.toCurrentlyPlaying(thumbnailWidth, thumbnailHeight), nil
+}
 
-			Artists: response.Track.Artists,
+// getCurrentlyPlaying is fetchCurrentlyPlaying for polling devices. The state is
+// shared between all devices of the user for a short time, and while spotify rate
+// limits the user the last good state is served marked as stale.
+func (client *SpotifyClient) getCurrentlyPlaying(userId string, token *spotifyToken, thumbnailWidth, thumbnailHeight int) (currentlyPlaying SpotifyCurrentlyPlaying, err error) {
+	snapshot, err := client.loadPlayerSnapshot(userId, token)
+	if err != nil {
+		return currentlyPlaying, err
+	}
+
+	return snapshot.toCurrentlyPlaying(thumbnailWidth, thumbnailHeight), nil
+}
+
+func SpotifyCurrentlyPlayingHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		token, err := client.getTokenForRequest(app, c)
+		if err != nil {
+			return err
+		}
+
+		thumbnailWidth, thumbnailHeight := parseSpotifyThumbnailSize(c)
+
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+		currentlyPlaying, err := client.getCurrentlyPlaying(record.Id, token, thumbnailWidth, thumbnailHeight)
+		if err != nil {
+			return err
 		}
 
 		return c.JSON(200, currentlyPlaying)
 	}
 }
 
-func SpotifyCurrentlyPlayingArtHandler(app *pocketbase.PocketBase) func(c echo.Context) error {
+// SpotifyCurrentlyPlayingArtHandler scales the album art at `url` to the thumbnail
+// size and encodes it as described by parseImageOptions.
+func SpotifyCurrentlyPlayingArtHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
 	return func(c echo.Context) error {
 
 		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
@@ -423,17 +608,7 @@ func SpotifyCurrentlyPlayingArtHandler(app *pocketbase.PocketBase) func(c echo.C
 			return apis.NewBadRequestError("url is required", nil)
 		}
 
-		thumbnailWidthRaw := c.QueryParam("thumbnailWidth")
-		thumbnailHeightRaw := c.QueryParam("thumbnailHeight")
-
-		thumbnailWidth := 0
-		thumbnailHeight := 0
-		if thumbnailWidthRaw != "" {
-			thumbnailWidth, _ = strconv.Atoi(thumbnailWidthRaw)
-		}
-		if thumbnailHeightRaw != "" {
-			thumbnailHeight, _ = strconv.Atoi(thumbnailHeightRaw)
-		}
+		thumbnailWidth, thumbnailHeight := parseSpotifyThumbnailSize(c)
 
 		if thumbnailWidth <= 0 || thumbnailHeight <= 0 {
 			return apis.NewBadRequestError("thumbnailWidth and thumbnailHeight must be greater than 0", nil)
@@ -442,13 +617,18 @@ func SpotifyCurrentlyPlayingArtHandler(app *pocketbase.PocketBase) func(c echo.C
 			return apis.NewBadRequestError("thumbnailWidth and thumbnailHeight must be less than 320", nil)
 		}
 
-		albumArtBmp, thumbnailErr := loadSpotifyAlbumArt(url, thumbnailWidth, thumbnailHeight)
+		imageOptions, err := parseImageOptions(c)
+		if err != nil {
+			return err
+		}
+
+		albumArtBmp, thumbnailErr := client.loadAlbumArt(url, thumbnailWidth, thumbnailHeight, imageOptions)
 
 		if thumbnailErr != nil {
 			fmt.Println("error loading album art")
 			fmt.Println(thumbnailErr)
 		}
 
-		return c.Blob(200, "image/bmp", albumArtBmp)
+		return c.Blob(200, imageOptions.Format.ContentType(), albumArtBmp)
 	}
 }
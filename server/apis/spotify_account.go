@@ -0,0 +1,250 @@
+package apis
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+
+	"keyboard-api/secrets"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	// machine readable reasons reported in the `data.reason` field of error responses
+	SPOTIFY_REASON_NOT_CONNECTED      = "spotify_not_connected"
+	SPOTIFY_REASON_RECONNECT_REQUIRED = "spotify_reconnect_required"
+	SPOTIFY_REASON_RATE_LIMITED       = "spotify_rate_limited"
+	SPOTIFY_REASON_UNAVAILABLE        = "spotify_unavailable"
+	SPOTIFY_REASON_TOKEN_REJECTED     = "spotify_token_rejected"
+)
+
+var ErrSpotifyReconnectRequired = errors.New("spotify refresh token was revoked")
+
+// spotifyReasonError is an api error that devices can tell apart by data.reason
+// instead of the human readable message.
+func spotifyReasonError(status int, message, reason string) *apis.ApiError {
+	err := apis.NewApiError(status, message, nil)
+	err.Data = map[string]any{
+		"reason": reason,
+	}
+	return err
+}
+
+// spotifyTokenApiError maps an error from getToken to the response sent to devices.
+// Errors that already are api errors, e.g. a rate limit, are passed through.
+func spotifyTokenApiError(err error) *apis.ApiError {
+	var apiErr *apis.ApiError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, ErrSpotifyNotConnected):
+		return spotifyReasonError(409, "Spotify is not connected", SPOTIFY_REASON_NOT_CONNECTED)
+	case errors.Is(err, ErrSpotifyReconnectRequired):
+		return spotifyReasonError(409, "Spotify needs to be connected again", SPOTIFY_REASON_RECONNECT_REQUIRED)
+	case errors.Is(err, secrets.ErrNoKey):
+		log.Println(err)
+		return apis.NewApiError(500, "The server can not decrypt spotify credentials, CREDENTIALS_KEY is not configured", nil)
+	}
+	return apis.NewBadRequestError("Could not get spotify token", nil)
+}
+
+// spotifyTokenRejectedError is returned by sendApiRequest when spotify answers 401, i.e.
+// it no longer accepts an access token that has not expired yet by our clock.
+func spotifyTokenRejectedError() *apis.ApiError {
+	return spotifyReasonError(502, "Spotify rejected the access token", SPOTIFY_REASON_TOKEN_REJECTED)
+}
+
+func isTokenRejected(err error) bool {
+	var apiErr *apis.ApiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	reason, _ := apiErr.Data["reason"].(string)
+	return reason == SPOTIFY_REASON_TOKEN_REJECTED
+}
+
+// spotifyToken is the access token a request acts with. apiRequest replaces it
+// when spotify rejects it, so the following calls of the request use the new one.
+type spotifyToken struct {
+	app    *pocketbase.PocketBase
+	userId string
+
+	mu          sync.Mutex
+	accessToken string
+}
+
+func newSpotifyToken(app *pocketbase.PocketBase, userId, accessToken string) *spotifyToken {
+	return &spotifyToken{
+		app:         app,
+		userId:      userId,
+		accessToken: accessToken,
+	}
+}
+
+func (token *spotifyToken) get() string {
+	token.mu.Lock()
+	defer token.mu.Unlock()
+
+	return token.accessToken
+}
+
+// renewRejectedToken drops the user's cached access token after spotify rejected
+// rejectedToken and returns a freshly refreshed one. Calls sharing the token only
+// refresh it once.
+func (client *SpotifyClient) renewRejectedToken(token *spotifyToken, rejectedToken string) (string, error) {
+	token.mu.Lock()
+	defer token.mu.Unlock()
+
+	if token.accessToken != rejectedToken {
+		return token.accessToken, nil
+	}
+
+	client.tokenCache.Delete(token.userId)
+
+	accessToken, err := client.refreshToken(token.app, token.userId, rejectedToken)
+	if err != nil {
+		return "", spotifyTokenApiError(err)
+	}
+
+	token.accessToken = accessToken
+	return accessToken, nil
+}
+
+func isInvalidGrant(body []byte) bool {
+	var response struct {
+		Error string `json:"error"`
+	}
+	err := json.Unmarshal(body, &response)
+	return err == nil && response.Error == "invalid_grant"
+}
+
+// markNeedsReauth records that the user revoked access (or the refresh token
+// expired) so later requests fail fast until the user logs in again.
+func (client *SpotifyClient) markNeedsReauth(app *pocketbase.PocketBase, user *models.Record, creds SpotifyCredentials) error {
+	client.tokenCache.Delete(user.Id)
+
+	creds.AccessToken = ""
+	creds.NeedsReauth = true
+
+	err := WriteSpotifyCredentials(user, creds)
+	if err != nil {
+		return err
+	}
+	err = app.Dao().SaveRecord(user)
+	if err != nil {
+		return err
+	}
+
+	return ErrSpotifyReconnectRequired
+}
+
+type SpotifyStatus struct {
+	Connected   bool     `json:"connected"`
+	NeedsReauth bool     `json:"needs_reauth"`
+	Scopes      []string `json:"scopes"`
+	ExpiresAt   int64    `json:"expires_at"`
+	DisplayName string   `json:"display_name"`
+}
+
+func (client *SpotifyClient) getStatus(app *pocketbase.PocketBase, user *models.Record) (status SpotifyStatus, err error) {
+	status.Scopes = []string{}
+
+	creds, err := ReadSpotifyCredentials(user)
+	if errors.Is(err, ErrSpotifyNotConnected) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+
+	status.Connected = true
+	status.NeedsReauth = creds.NeedsReauth
+	status.ExpiresAt = creds.ExpiresAt
+	if creds.Scope != "" {
+		status.Scopes = strings.Fields(creds.Scope)
+	}
+
+	if status.NeedsReauth {
+		return status, nil
+	}
+
+	token, err := client.getToken(app, user)
+	if errors.Is(err, ErrSpotifyReconnectRequired) {
+		status.NeedsReauth = true
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+
+	// the token may have been refreshed
+	if cached, ok := client.tokenCache.Load(user.Id); ok {
+		status.ExpiresAt = cached.(SpotifyCredentials).ExpiresAt
+	}
+
+	statusCode, body, err := client.apiRequest(newSpotifyToken(app, user.Id, token), "GET", "/me", nil, nil)
+	if err == nil && statusCode == 200 {
+		var profile struct {
+			DisplayName string `json:"display_name"`
+		}
+		if json.Unmarshal(body, &profile) == nil {
+			status.DisplayName = profile.DisplayName
+		}
+	}
+
+	return status, nil
+}
+
+// SpotifyStatusHandler reports whether the user linked spotify and whether the
+// link still works.
+func SpotifyStatusHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+		if record == nil {
+			return apis.NewForbiddenError("You must be logged in", nil)
+		}
+
+		status, err := client.getStatus(app, record)
+		if errors.Is(err, secrets.ErrNoKey) {
+			return spotifyTokenApiError(err)
+		}
+		if err != nil {
+			return apis.NewBadRequestError("Could not read spotify credentials", nil)
+		}
+
+		return c.JSON(200, status)
+	}
+}
+
+// SpotifyDisconnectHandler removes the stored spotify credentials of the user.
+func SpotifyDisconnectHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+		if record == nil {
+			return apis.NewForbiddenError("You must be logged in", nil)
+		}
+
+		record.Set("spotify", nil)
+		err := app.Dao().SaveRecord(record)
+		if err != nil {
+			return apis.NewBadRequestError("Could not disconnect spotify", nil)
+		}
+
+		client.tokenCache.Delete(record.Id)
+		client.lastPlayerState.Delete(record.Id)
+		client.savedState.Delete(record.Id)
+		client.invalidatePlayerState(record.Id)
+
+		return c.JSON(200, SpotifyStatus{
+			Scopes: []string{},
+		})
+	}
+}
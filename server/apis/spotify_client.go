@@ -0,0 +1,168 @@
+package apis
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	SPOTIFY_ACCOUNTS_URL = "https://accounts.spotify.com"
+	SPOTIFY_API_URL      = "https://api.spotify.com/v1"
+)
+
+// SpotifyClient holds the endpoints and credentials used to talk to spotify. The
+// spotify handlers receive it from main so the base urls and http client can be
+// swapped out, e.g. for the fake server in apis/spotifytest.
+type SpotifyClient struct {
+	AccountsUrl  string
+	ApiUrl       string
+	ClientId     string
+	ClientSecret string
+	HttpClient   *http.Client
+	// key used to sign OauthState, a random one is generated when empty
+	StateSecret []byte
+
+	stateSecretOnce sync.Once
+	noncesMu        sync.Mutex
+	// not persisted, see OauthState
+	pendingNonces map[string]int64
+
+	// per user id, see getToken and refreshToken
+	tokenCache   sync.Map
+	refreshGroup singleflight.Group
+
+	// per user id, see rateLimitedFetch and loadPlayerSnapshot
+	rateLimitedUntil  sync.Map
+	lastPlayerState   sync.Map
+	playerInvalidated sync.Map
+	playerStateGroup  singleflight.Group
+
+	// per user id, see loadTrackSaved
+	savedState sync.Map
+
+	// per user id, see subscribePlayerStream
+	streamsMu sync.Mutex
+	streams   map[string]*spotifyStream
+}
+
+// NewSpotifyClient returns a client for the real spotify api, using the app
+// credentials from the environment.
+func NewSpotifyClient() *SpotifyClient {
+	return &SpotifyClient{
+		AccountsUrl:  SPOTIFY_ACCOUNTS_URL,
+		ApiUrl:       SPOTIFY_API_URL,
+		ClientId:     os.Getenv("SPOTIFY_CLIENT_ID"),
+		ClientSecret: os.Getenv("SPOTIFY_CLIENT_SECRET"),
+		HttpClient:   http.DefaultClient,
+		StateSecret:  []byte(os.Getenv("SPOTIFY_STATE_SECRET")),
+	}
+}
+
+func (client *SpotifyClient) authorizeUrl(redirectUri, scope, state string) string {
+	return fmt.Sprintf("%s/authorize?client_id=%s&response_type=code&redirect_uri=%s&scope=%s&state=%s", client.AccountsUrl, url.QueryEscape(client.ClientId), url.QueryEscape(redirectUri), url.QueryEscape(scope), url.QueryEscape(state))
+}
+
+// tokenRequest posts payload to the accounts token endpoint, authenticating with
+// the app credentials, and returns the raw response body. Like apiRequest, rate
+// limits and outages are returned as errors devices can tell apart.
+func (client *SpotifyClient) tokenRequest(payload url.Values) (statusCode int, body []byte, err error) {
+	req, _ := http.NewRequest("POST", client.AccountsUrl+"/api/token", strings.NewReader(payload.Encode()))
+
+	authorizationToken := base64.StdEncoding.EncodeToString([]byte(client.ClientId + ":" + client.ClientSecret))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", authorizationToken))
+
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == 429:
+		return resp.StatusCode, nil, spotifyRateLimitedError(parseRetryAfter(resp.Header.Get("Retry-After")))
+	case resp.StatusCode >= 500:
+		return resp.StatusCode, nil, spotifyReasonError(502, "Spotify is currently unavailable", SPOTIFY_REASON_UNAVAILABLE)
+	}
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	return resp.StatusCode, body, nil
+}
+
+// apiRequest calls a Web API endpoint relative to ApiUrl, JSON encoding payload as
+// the request body when it is not nil. When spotify rejects the access token, it
+// is refreshed and the request is sent once more.
+func (client *SpotifyClient) apiRequest(token *spotifyToken, method, path string, query url.Values, payload any) (statusCode int, body []byte, err error) {
+	accessToken := token.get()
+
+	statusCode, body, err = client.sendApiRequest(accessToken, method, path, query, payload)
+	if !isTokenRejected(err) {
+		return statusCode, body, err
+	}
+
+	// spotify did not run the request, so it is safe to repeat it
+	accessToken, err = client.renewRejectedToken(token, accessToken)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return client.sendApiRequest(accessToken, method, path, query, payload)
+}
+
+func (client *SpotifyClient) sendApiRequest(accessToken, method, path string, query url.Values, payload any) (statusCode int, body []byte, err error) {
+	requestUrl := client.ApiUrl + path
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if payload != nil {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		reqBody = bytes.NewReader(payloadBytes)
+	}
+
+	req, _ := http.NewRequest(method, requestUrl, reqBody)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	if payload != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == 401:
+		return resp.StatusCode, nil, spotifyTokenRejectedError()
+	case resp.StatusCode == 429:
+		return resp.StatusCode, nil, spotifyRateLimitedError(parseRetryAfter(resp.Header.Get("Retry-After")))
+	case resp.StatusCode >= 500:
+		return resp.StatusCode, nil, spotifyReasonError(502, "Spotify is currently unavailable", SPOTIFY_REASON_UNAVAILABLE)
+	}
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	return resp.StatusCode, body, nil
+}
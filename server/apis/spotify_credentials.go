@@ -0,0 +1,158 @@
+package apis
+
+import (
+	"encoding/json"
+	"errors"
+	"keyboard-api/secrets"
+	"sync"
+
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var ErrSpotifyNotConnected = errors.New("could not find spotify credentials")
+
+var credentialsKeyring = sync.OnceValues(secrets.KeyringFromEnv)
+
+// storedSpotifyCredentials is the shape of the users.spotify field. Older records
+// hold the SpotifyCredentials in plain text instead.
+type storedSpotifyCredentials struct {
+	Encrypted *secrets.Sealed `json:"encrypted"`
+}
+
+// readStoredSpotifyCredentials returns the credentials in the user's spotify field
+// and whether they need to be re-encrypted with the current key.
+func readStoredSpotifyCredentials(keyring *secrets.Keyring, user *models.Record) (creds SpotifyCredentials, stale bool, err error) {
+	var raw []byte
+	switch value := user.Get("spotify").(type) {
+	case nil:
+	case types.JsonRaw:
+		raw = value
+	default:
+		// not yet normalized by the json field, e.g. set during this request
+		raw, err = json.Marshal(value)
+		if err != nil {
+			return creds, false, err
+		}
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return creds, false, ErrSpotifyNotConnected
+	}
+
+	var stored storedSpotifyCredentials
+	err = json.Unmarshal(raw, &stored)
+	if err != nil {
+		return creds, false, err
+	}
+
+	if stored.Encrypted == nil {
+		// stored before credentials were encrypted
+		err = json.Unmarshal(raw, &creds)
+		if err != nil {
+			return creds, false, err
+		}
+		if creds.RefreshToken == "" && creds.AccessToken == "" {
+			return creds, false, ErrSpotifyNotConnected
+		}
+		return creds, true, nil
+	}
+
+	plaintext, err := keyring.Decrypt(*stored.Encrypted)
+	if err != nil {
+		return creds, false, err
+	}
+	err = json.Unmarshal(plaintext, &creds)
+	if err != nil {
+		return creds, false, err
+	}
+
+	return creds, !keyring.IsCurrent(*stored.Encrypted), nil
+}
+
+func writeStoredSpotifyCredentials(keyring *secrets.Keyring, user *models.Record, creds SpotifyCredentials) error {
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := keyring.Encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+
+	user.Set("spotify", storedSpotifyCredentials{
+		Encrypted: &sealed,
+	})
+	return nil
+}
+
+// ReadSpotifyCredentials decrypts the spotify credentials stored on a user record.
+// It returns ErrSpotifyNotConnected when the user never linked spotify, and
+// secrets.ErrNoKey when they can not be decrypted because CREDENTIALS_KEY is unset.
+func ReadSpotifyCredentials(user *models.Record) (creds SpotifyCredentials, err error) {
+	keyring, err := credentialsKeyring()
+	if err != nil {
+		return creds, err
+	}
+
+	creds, _, err = readStoredSpotifyCredentials(keyring, user)
+	if errors.Is(err, secrets.ErrUnknownKey) && !keyring.CanEncrypt() {
+		return creds, secrets.ErrNoKey
+	}
+	return creds, err
+}
+
+// WriteSpotifyCredentials encrypts creds into the user's spotify field. The record
+// still has to be saved by the caller.
+func WriteSpotifyCredentials(user *models.Record, creds SpotifyCredentials) error {
+	keyring, err := credentialsKeyring()
+	if err != nil {
+		return err
+	}
+
+	return writeStoredSpotifyCredentials(keyring, user, creds)
+}
+
+// ReencryptSpotifyCredentials rewrites every stored credential that is in plain
+// text or encrypted with a previous key using the current key, to rotate
+// CREDENTIALS_KEY.
+func ReencryptSpotifyCredentials(dao *daos.Dao) (count int, err error) {
+	keyring, err := credentialsKeyring()
+	if err != nil {
+		return 0, err
+	}
+	if !keyring.CanEncrypt() {
+		return 0, secrets.ErrNoKey
+	}
+
+	users, err := dao.FindRecordsByExpr("users")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, user := range users {
+		creds, stale, err := readStoredSpotifyCredentials(keyring, user)
+		if errors.Is(err, ErrSpotifyNotConnected) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		if !stale {
+			continue
+		}
+
+		err = writeStoredSpotifyCredentials(keyring, user, creds)
+		if err != nil {
+			return count, err
+		}
+		err = dao.SaveRecord(user)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
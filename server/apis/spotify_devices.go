@@ -0,0 +1,156 @@
+package apis
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+type SpotifyDevice struct {
+	Id            string `json:"id"`
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	IsActive      bool   `json:"is_active"`
+	VolumePercent int    `json:"volume_percent"`
+}
+
+func (client *SpotifyClient) fetchDevices(token *spotifyToken) (devices []SpotifyDevice, err error) {
+	statusCode, body, err := client.apiRequest(token, "GET", "/me/player/devices", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode >= 300 {
+		return nil, apis.NewBadRequestError("Could not get spotify devices", nil)
+	}
+
+	var response struct {
+		Devices []RawSpotifyDevice `json:"devices"`
+	}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, apis.NewBadRequestError("Could not parse response", nil)
+	}
+
+	devices = []SpotifyDevice{}
+	for _, device := range response.Devices {
+		// restricted devices and devices without an id can not be controlled through the api
+		if device.Id == "" || device.IsRestricted {
+			continue
+		}
+		devices = append(devices, SpotifyDevice{
+			Id:            device.Id,
+			Name:          device.Name,
+			Type:          device.Type,
+			IsActive:      device.IsActive,
+			VolumePercent: device.VolumePercent,
+		})
+	}
+
+	return devices, nil
+}
+
+// cycleSpotifyDevice returns the id of the device after (or before, when step is
+// negative) the active one, wrapping around the list.
+func cycleSpotifyDevice(devices []SpotifyDevice, step int) string {
+	if len(devices) == 0 {
+		return ""
+	}
+
+	activeIndex := -1
+	for index, device := range devices {
+		if device.IsActive {
+			activeIndex = index
+			break
+		}
+	}
+	if activeIndex == -1 {
+		return devices[0].Id
+	}
+
+	nextIndex := ((activeIndex+step)%len(devices) + len(devices)) % len(devices)
+	return devices[nextIndex].Id
+}
+
+func SpotifyDevicesHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		token, err := client.getTokenForRequest(app, c)
+		if err != nil {
+			return err
+		}
+
+		devices, err := client.fetchDevices(token)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(200, devices)
+	}
+}
+
+// SpotifyTransferHandler moves playback to the device given by `device_id`, or to the
+// next/previous device when `direction` is set. Playback starts on the new device
+// when `play` is true, otherwise the current play state is kept.
+func SpotifyTransferHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		token, err := client.getTokenForRequest(app, c)
+		if err != nil {
+			return err
+		}
+
+		deviceId := c.QueryParam("device_id")
+		direction := c.QueryParam("direction")
+
+		play := false
+		playRaw := c.QueryParam("play")
+		if playRaw != "" {
+			play, err = strconv.ParseBool(playRaw)
+			if err != nil {
+				return apis.NewBadRequestError("play must be true or false", nil)
+			}
+		}
+
+		devices, err := client.fetchDevices(token)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case deviceId != "":
+		case direction == "next":
+			deviceId = cycleSpotifyDevice(devices, 1)
+		case direction == "previous":
+			deviceId = cycleSpotifyDevice(devices, -1)
+		case direction != "":
+			return apis.NewBadRequestError("direction must be next or previous", nil)
+		default:
+			return apis.NewBadRequestError("device_id or direction is required", nil)
+		}
+
+		if deviceId == "" {
+			return apis.NewNotFoundError("No spotify devices available", nil)
+		}
+
+		err = client.playerCommand(token, "PUT", "", nil, struct {
+			DeviceIds []string `json:"device_ids"`
+			Play      bool     `json:"play"`
+		}{
+			DeviceIds: []string{deviceId},
+			Play:      play,
+		})
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+		client.invalidatePlayerState(record.Id)
+		if err != nil {
+			return err
+		}
+
+		for index := range devices {
+			devices[index].IsActive = devices[index].Id == deviceId
+		}
+
+		return c.JSON(200, devices)
+	}
+}
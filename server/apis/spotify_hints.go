@@ -0,0 +1,54 @@
+package apis
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	SPOTIFY_MIN_POLL_MS = 1000
+	// even while a long track plays, poll now and then to notice skips from other devices
+	SPOTIFY_MAX_POLL_MS = 15000
+	// used while paused or idle, when there is no track end to wait for
+	SPOTIFY_IDLE_POLL_MS = 5000
+)
+
+// updateHints fills the fields that help devices poll less often. It has to run
+// again after fields are patched, e.g. by a playback command override.
+func (currentlyPlaying *SpotifyCurrentlyPlaying) updateHints() {
+	currentlyPlaying.ServerTimeMs = time.Now().UnixMilli()
+	currentlyPlaying.StateHash = currentlyPlaying.stateHash()
+	currentlyPlaying.NextPollMs = currentlyPlaying.nextPollMs()
+}
+
+func (currentlyPlaying *SpotifyCurrentlyPlaying) stateHash() string {
+	hash := fnv.New64a()
+	hash.Write([]byte(currentlyPlaying.MediaType))
+	hash.Write([]byte{0})
+	hash.Write([]byte(currentlyPlaying.TrackId))
+	hash.Write([]byte{0})
+	hash.Write([]byte(currentlyPlaying.AlbumArtUrl))
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+func (currentlyPlaying *SpotifyCurrentlyPlaying) nextPollMs() int {
+	if !currentlyPlaying.IsPlaying || currentlyPlaying.TrackLengthMs <= 0 {
+		return SPOTIFY_IDLE_POLL_MS
+	}
+
+	// the progress may have been sampled a while ago when served from the cache
+	elapsedMs := int(currentlyPlaying.ServerTimeMs - currentlyPlaying.ProgressSampledAtMs)
+	if elapsedMs < 0 {
+		elapsedMs = 0
+	}
+
+	remainingMs := currentlyPlaying.TrackLengthMs - currentlyPlaying.TrackProgressMs - elapsedMs
+	if remainingMs < SPOTIFY_MIN_POLL_MS {
+		return SPOTIFY_MIN_POLL_MS
+	}
+	if remainingMs > SPOTIFY_MAX_POLL_MS {
+		return SPOTIFY_MAX_POLL_MS
+	}
+	return remainingMs
+}
@@ -0,0 +1,105 @@
+package apis
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+const (
+	SPOTIFY_RECENTLY_PLAYED_DEFAULT_LIMIT = 5
+	SPOTIFY_RECENTLY_PLAYED_MAX_LIMIT     = 50
+)
+
+type SpotifyRecentlyPlayedItem struct {
+	SpotifyCurrentlyPlaying
+	PlayedAtMs int64 `json:"played_at_ms"`
+}
+
+type SpotifyRecentlyPlayed struct {
+	Items []SpotifyRecentlyPlayedItem `json:"items"`
+	// pass as `before` to load the next (older) page, empty when there are no more items
+	NextCursor string `json:"next_cursor"`
+}
+
+// SpotifyRecentlyPlayedHandler returns the last `limit` played tracks, most recent
+// first. Older pages are loaded by passing the returned cursor as `before`.
+func SpotifyRecentlyPlayedHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		token, err := client.getTokenForRequest(app, c)
+		if err != nil {
+			return err
+		}
+
+		limit := SPOTIFY_RECENTLY_PLAYED_DEFAULT_LIMIT
+		limitRaw := c.QueryParam("limit")
+		if limitRaw != "" {
+			limit, err = strconv.Atoi(limitRaw)
+			if err != nil || limit <= 0 {
+				return apis.NewBadRequestError("limit must be a number greater than 0", nil)
+			}
+		}
+		if limit > SPOTIFY_RECENTLY_PLAYED_MAX_LIMIT {
+			limit = SPOTIFY_RECENTLY_PLAYED_MAX_LIMIT
+		}
+
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(limit))
+
+		before := c.QueryParam("before")
+		if before != "" {
+			if _, err := strconv.ParseInt(before, 10, 64); err != nil {
+				return apis.NewBadRequestError("before is not a valid cursor", nil)
+			}
+			query.Set("before", before)
+		}
+
+		thumbnailWidth, thumbnailHeight := parseSpotifyThumbnailSize(c)
+
+		statusCode, body, err := client.apiRequest(token, "GET", "/me/player/recently-played", query, nil)
+		if err != nil {
+			return err
+		}
+		if statusCode == 403 {
+			return apis.NewForbiddenError("Missing permission to read recently played tracks, please log in to spotify again", nil)
+		}
+		if statusCode >= 300 {
+			return apis.NewBadRequestError("Could not get recently played tracks", nil)
+		}
+
+		var response struct {
+			Items []struct {
+				Track    RawSpotifyItem `json:"track"`
+				PlayedAt time.Time      `json:"played_at"`
+			} `json:"items"`
+			Next    string `json:"next"`
+			Cursors *struct {
+				Before string `json:"before"`
+			} `json:"cursors"`
+		}
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return apis.NewBadRequestError("Could not parse response", nil)
+		}
+
+		recentlyPlayed := SpotifyRecentlyPlayed{
+			Items: []SpotifyRecentlyPlayedItem{},
+		}
+		for _, item := range response.Items {
+			recentlyPlayed.Items = append(recentlyPlayed.Items, SpotifyRecentlyPlayedItem{
+				SpotifyCurrentlyPlaying: item.Track.toCurrentlyPlaying(thumbnailWidth, thumbnailHeight),
+				PlayedAtMs:              item.PlayedAt.UnixMilli(),
+			})
+		}
+		if response.Next != "" && response.Cursors != nil {
+			recentlyPlayed.NextCursor = response.Cursors.Before
+		}
+
+		return c.JSON(200, recentlyPlayed)
+	}
+}
@@ -0,0 +1,134 @@
+package apis
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	// the liked state only changes when the user likes a track, so it is checked
+	// much less often than the player state
+	SPOTIFY_SAVED_STATE_TTL_MS = 30000
+)
+
+type cachedSavedState struct {
+	trackId   string
+	saved     bool
+	checkedAt time.Time
+}
+
+// loadTrackSaved is isTrackSaved, remembering the answer for the user's current track
+func (client *SpotifyClient) loadTrackSaved(userId string, token *spotifyToken, trackId string) (bool, error) {
+	if cached, ok := client.savedState.Load(userId); ok {
+		cachedState := cached.(cachedSavedState)
+		if cachedState.trackId == trackId && time.Since(cachedState.checkedAt) < SPOTIFY_SAVED_STATE_TTL_MS*time.Millisecond {
+			return cachedState.saved, nil
+		}
+	}
+
+	saved, err := client.isTrackSaved(token, trackId)
+	if err != nil {
+		return false, err
+	}
+
+	client.storeTrackSaved(userId, trackId, saved)
+	return saved, nil
+}
+
+func (client *SpotifyClient) storeTrackSaved(userId, trackId string, saved bool) {
+	client.savedState.Store(userId, cachedSavedState{
+		trackId:   trackId,
+		saved:     saved,
+		checkedAt: time.Now(),
+	})
+}
+
+func (client *SpotifyClient) isTrackSaved(token *spotifyToken, trackId string) (bool, error) {
+	if trackId == "" {
+		return false, nil
+	}
+
+	query := url.Values{}
+	query.Set("ids", trackId)
+
+	statusCode, body, err := client.apiRequest(token, "GET", "/me/tracks/contains", query, nil)
+	if err != nil {
+		return false, err
+	}
+	if statusCode >= 300 {
+		return false, apis.NewBadRequestError("Could not check liked songs", nil)
+	}
+
+	var saved []bool
+	err = json.Unmarshal(body, &saved)
+	if err != nil || len(saved) == 0 {
+		return false, apis.NewBadRequestError("Could not parse response", nil)
+	}
+
+	return saved[0], nil
+}
+
+func (client *SpotifyClient) setTrackSaved(token *spotifyToken, trackId string, saved bool) error {
+	query := url.Values{}
+	query.Set("ids", trackId)
+
+	method := "DELETE"
+	if saved {
+		method = "PUT"
+	}
+
+	statusCode, _, err := client.apiRequest(token, method, "/me/tracks", query, nil)
+	if err != nil {
+		return err
+	}
+	if statusCode == 403 {
+		return apis.NewForbiddenError("Missing permission to modify liked songs, please log in to spotify again", nil)
+	}
+	if statusCode >= 300 {
+		return apis.NewBadRequestError("Could not update liked songs", nil)
+	}
+
+	return nil
+}
+
+// SpotifyToggleSavedHandler adds the current track to the user's Liked Songs, or
+// removes it if it is already saved.
+func SpotifyToggleSavedHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+		state, err := client.fetchPlayerState(token)
+		if err != nil {
+			return nil, err
+		}
+		if state.CurrentlyPlayingType != "track" || state.Item.Id == "" {
+			return nil, apis.NewBadRequestError("No track is currently playing", nil)
+		}
+
+		// unlike for the now playing payload the liked state has to be known here
+		trackId := state.Item.Id
+		isSaved, err := client.isTrackSaved(token, trackId)
+		if err != nil {
+			return nil, err
+		}
+
+		saved := !isSaved
+		err = client.setTrackSaved(token, trackId, saved)
+		if err != nil {
+			return nil, err
+		}
+		client.storeTrackSaved(record.Id, trackId, saved)
+
+		return func(currentlyPlaying *SpotifyCurrentlyPlaying) {
+			if currentlyPlaying.TrackId == trackId {
+				currentlyPlaying.IsSaved = saved
+			}
+		}, nil
+	})
+}
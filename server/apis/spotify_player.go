@@ -0,0 +1,293 @@
+package apis
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	// Spotify applies playback commands asynchronously, so reading the player
+	// state immediately after a command can still return the previous track.
+	SPOTIFY_PLAYBACK_SETTLE_MS = 300
+)
+
+func (client *SpotifyClient) playerCommand(token *spotifyToken, method, path string, query url.Values, payload any) error {
+	statusCode, _, err := client.apiRequest(token, method, "/me/player"+path, query, payload)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case statusCode == 404:
+		return apis.NewNotFoundError("No active spotify device", nil)
+	case statusCode == 403:
+		return apis.NewForbiddenError("Spotify refused the playback command", nil)
+	case statusCode >= 300:
+		return apis.NewBadRequestError("Spotify playback command failed", nil)
+	}
+
+	return nil
+}
+
+// spotifyPlayerActionHandler runs a playback command for the logged in user and
+// responds with the resulting player state so the device can redraw from one request.
+// Actions may return an override to patch fields that Spotify reports with a delay.
+func spotifyPlayerActionHandler(app *pocketbase.PocketBase, client *SpotifyClient, action func(token *spotifyToken, c echo.Context) (override func(*SpotifyCurrentlyPlaying), err error)) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		token, err := client.getTokenForRequest(app, c)
+		if err != nil {
+			return err
+		}
+
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+		override, err := action(token, c)
+		// even a failed command may have changed something
+		client.invalidatePlayerState(record.Id)
+		if err != nil {
+			return err
+		}
+
+		time.Sleep(SPOTIFY_PLAYBACK_SETTLE_MS * time.Millisecond)
+		// other devices polling during the sleep may have cached the state from
+		// before spotify applied the command
+		client.invalidatePlayerState(record.Id)
+
+		thumbnailWidth, thumbnailHeight := parseSpotifyThumbnailSize(c)
+
+		currentlyPlaying, err := client.getCurrentlyPlaying(record.Id, token, thumbnailWidth, thumbnailHeight)
+		if err != nil {
+			return err
+		}
+
+		if override != nil {
+			override(&currentlyPlaying)
+			currentlyPlaying.updateHints()
+		}
+
+		return c.JSON(200, currentlyPlaying)
+	}
+}
+
+func SpotifyPlayPauseHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		currentlyPlaying, err := client.fetchCurrentlyPlaying(token, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if currentlyPlaying.IsPlaying {
+			return nil, client.playerCommand(token, "PUT", "/pause", nil, nil)
+		}
+		return nil, client.playerCommand(token, "PUT", "/play", nil, nil)
+	})
+}
+
+func SpotifyNextHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		return nil, client.playerCommand(token, "POST", "/next", nil, nil)
+	})
+}
+
+func SpotifyPreviousHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		return nil, client.playerCommand(token, "POST", "/previous", nil, nil)
+	})
+}
+
+func clampVolume(volume int) int {
+	if volume < 0 {
+		return 0
+	}
+	if volume > 100 {
+		return 100
+	}
+	return volume
+}
+
+// SpotifyVolumeHandler changes the volume of the active device. It accepts either a
+// signed `delta` (e.g. +3 or -5) for rotary encoders, or an absolute `set` value.
+func SpotifyVolumeHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		deltaRaw := c.QueryParam("delta")
+		setRaw := c.QueryParam("set")
+
+		if deltaRaw == "" && setRaw == "" {
+			return nil, apis.NewBadRequestError("delta or set is required", nil)
+		}
+		if deltaRaw != "" && setRaw != "" {
+			return nil, apis.NewBadRequestError("only one of delta or set may be provided", nil)
+		}
+
+		state, err := client.fetchPlayerState(token)
+		if err != nil {
+			return nil, err
+		}
+		if state.Device == nil {
+			return nil, apis.NewNotFoundError("No active spotify device", nil)
+		}
+		if !state.Device.SupportsVolume {
+			return nil, apis.NewBadRequestError("The active spotify device does not support volume control", nil)
+		}
+
+		var volume int
+		if setRaw != "" {
+			volume, err = strconv.Atoi(setRaw)
+			if err != nil {
+				return nil, apis.NewBadRequestError("set is not a valid number", nil)
+			}
+		} else {
+			// an unescaped "+" in the query string decodes to a space
+			delta, err := strconv.Atoi(strings.TrimSpace(deltaRaw))
+			if err != nil {
+				return nil, apis.NewBadRequestError("delta is not a valid number", nil)
+			}
+			volume = state.Device.VolumePercent + delta
+		}
+		volume = clampVolume(volume)
+
+		query := url.Values{}
+		query.Set("volume_percent", strconv.Itoa(volume))
+		query.Set("device_id", state.Device.Id)
+
+		err = client.playerCommand(token, "PUT", "/volume", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(currentlyPlaying *SpotifyCurrentlyPlaying) {
+			currentlyPlaying.VolumePercent = volume
+		}, nil
+	})
+}
+
+func SpotifyToggleShuffleHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		state, err := client.fetchPlayerState(token)
+		if err != nil {
+			return nil, err
+		}
+
+		shuffle := !state.ShuffleState
+
+		query := url.Values{}
+		query.Set("state", strconv.FormatBool(shuffle))
+
+		err = client.playerCommand(token, "PUT", "/shuffle", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(currentlyPlaying *SpotifyCurrentlyPlaying) {
+			currentlyPlaying.ShuffleState = shuffle
+		}, nil
+	})
+}
+
+// nextRepeatState cycles off -> context -> track -> off
+func nextRepeatState(repeatState string) string {
+	switch repeatState {
+	case "off":
+		return "context"
+	case "context":
+		return "track"
+	default:
+		return "off"
+	}
+}
+
+func SpotifyCycleRepeatHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		state, err := client.fetchPlayerState(token)
+		if err != nil {
+			return nil, err
+		}
+
+		repeat := nextRepeatState(state.RepeatState)
+
+		query := url.Values{}
+		query.Set("state", repeat)
+
+		err = client.playerCommand(token, "PUT", "/repeat", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(currentlyPlaying *SpotifyCurrentlyPlaying) {
+			currentlyPlaying.RepeatState = repeat
+		}, nil
+	})
+}
+
+// SpotifySeekHandler moves the playback position of the current item, either by a
+// signed `delta` in seconds or to an absolute `position` in seconds.
+func SpotifySeekHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		deltaRaw := c.QueryParam("delta")
+		positionRaw := c.QueryParam("position")
+
+		if deltaRaw == "" && positionRaw == "" {
+			return nil, apis.NewBadRequestError("delta or position is required", nil)
+		}
+		if deltaRaw != "" && positionRaw != "" {
+			return nil, apis.NewBadRequestError("only one of delta or position may be provided", nil)
+		}
+
+		currentlyPlaying, err := client.fetchCurrentlyPlaying(token, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if currentlyPlaying.TrackLengthMs <= 0 {
+			return nil, apis.NewBadRequestError("Nothing is currently playing", nil)
+		}
+
+		var positionMs int
+		if positionRaw != "" {
+			position, err := strconv.ParseFloat(positionRaw, 64)
+			if err != nil || math.IsNaN(position) || math.IsInf(position, 0) {
+				return nil, apis.NewBadRequestError("position is not a valid number", nil)
+			}
+			positionMs = int(position * 1000)
+			if positionMs < 0 || positionMs > currentlyPlaying.TrackLengthMs {
+				return nil, apis.NewBadRequestError("position must be between 0 and the length of the track", nil)
+			}
+		} else {
+			// an unescaped "+" in the query string decodes to a space
+			delta, err := strconv.ParseFloat(strings.TrimSpace(deltaRaw), 64)
+			if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+				return nil, apis.NewBadRequestError("delta is not a valid number", nil)
+			}
+			positionMs = currentlyPlaying.TrackProgressMs + int(delta*1000)
+			if positionMs < 0 {
+				positionMs = 0
+			}
+			if positionMs > currentlyPlaying.TrackLengthMs {
+				positionMs = currentlyPlaying.TrackLengthMs
+			}
+		}
+
+		query := url.Values{}
+		query.Set("position_ms", strconv.Itoa(positionMs))
+
+		err = client.playerCommand(token, "PUT", "/seek", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		trackId := currentlyPlaying.TrackId
+		return func(currentlyPlaying *SpotifyCurrentlyPlaying) {
+			if currentlyPlaying.TrackId == trackId {
+				currentlyPlaying.TrackProgressMs = positionMs
+				currentlyPlaying.ProgressSampledAtMs = time.Now().UnixMilli()
+			}
+		}, nil
+	})
+}
@@ -0,0 +1,68 @@
+package apis
+
+import (
+	"time"
+)
+
+const (
+	// how long a fetched player state is shared between the devices of a user
+	SPOTIFY_PLAYER_STATE_TTL_MS = 1000
+)
+
+type cachedPlayerSnapshot struct {
+	snapshot spotifyPlayerSnapshot
+	// when the request that produced the snapshot was started
+	fetchedAt time.Time
+}
+
+func (client *SpotifyClient) invalidatedSince(userId string, since time.Time) bool {
+	invalidatedAt, ok := client.playerInvalidated.Load(userId)
+	return ok && !since.After(invalidatedAt.(time.Time))
+}
+
+func (client *SpotifyClient) isPlayerStateFresh(userId string, cached cachedPlayerSnapshot) bool {
+	return time.Since(cached.fetchedAt) < SPOTIFY_PLAYER_STATE_TTL_MS*time.Millisecond && !client.invalidatedSince(userId, cached.fetchedAt)
+}
+
+// loadPlayerSnapshot returns the user's player state from the cache when it is
+// fresh. Otherwise concurrent callers share a single request to spotify.
+func (client *SpotifyClient) loadPlayerSnapshot(userId string, token *spotifyToken) (spotifyPlayerSnapshot, error) {
+	if cached, ok := client.lastPlayerState.Load(userId); ok && client.isPlayerStateFresh(userId, cached.(cachedPlayerSnapshot)) {
+		return cached.(cachedPlayerSnapshot).snapshot, nil
+	}
+
+	result, err, _ := client.playerStateGroup.Do(userId, func() (any, error) {
+		fetchedAt := time.Now()
+
+		snapshot, err := client.rateLimitedFetch(userId, func() (spotifyPlayerSnapshot, error) {
+			return client.fetchPlayerSnapshot(userId, token)
+		})
+		if err != nil {
+			return snapshot, err
+		}
+
+		// a playback command may have invalidated the cache while this request
+		// was in flight, in which case its result is already outdated
+		if !snapshot.Stale && !client.invalidatedSince(userId, fetchedAt) {
+			client.lastPlayerState.Store(userId, cachedPlayerSnapshot{
+				snapshot:  snapshot,
+				fetchedAt: fetchedAt,
+			})
+		}
+
+		return snapshot, nil
+	})
+	if err != nil {
+		return spotifyPlayerSnapshot{}, err
+	}
+
+	return result.(spotifyPlayerSnapshot), nil
+}
+
+// invalidatePlayerState makes the next loadPlayerSnapshot for the user go to
+// spotify, e.g. after a playback command changed the state.
+func (client *SpotifyClient) invalidatePlayerState(userId string) {
+	client.playerInvalidated.Store(userId, time.Now())
+	// requests already in flight were started before the command
+	client.playerStateGroup.Forget(userId)
+}
@@ -0,0 +1,140 @@
+package apis
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+const (
+	SPOTIFY_QUEUE_DEFAULT_LIMIT = 5
+	// Spotify returns at most 20 upcoming items
+	SPOTIFY_QUEUE_MAX_LIMIT = 20
+)
+
+type SpotifyQueueItem struct {
+	Index       int      `json:"index"`
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Artists     []string `json:"artists"`
+	DurationMs  int      `json:"duration_ms"`
+	AlbumArtUrl string   `json:"album_art_url"`
+}
+
+// truncateText shortens text to at most maxLength runes. A maxLength of 0 or less
+// leaves the text unchanged.
+func truncateText(text string, maxLength int) string {
+	runes := []rune(text)
+	if maxLength <= 0 || len(runes) <= maxLength {
+		return text
+	}
+	if maxLength <= 3 {
+		return string(runes[:maxLength])
+	}
+	return string(runes[:maxLength-3]) + "..."
+}
+
+func (item *RawSpotifyItem) toQueueItem(index, maxLength, thumbnailWidth, thumbnailHeight int) SpotifyQueueItem {
+	artists := []string{}
+
+	if item.Type == "episode" {
+		artists = append(artists, truncateText(item.Show.Name, maxLength))
+	} else {
+		for _, artist := range item.Artists {
+			artists = append(artists, truncateText(artist.Name, maxLength))
+		}
+	}
+
+	return SpotifyQueueItem{
+		Index:       index,
+		Id:          item.Id,
+		Name:        truncateText(item.Name, maxLength),
+		Artists:     artists,
+		DurationMs:  item.DurationMs,
+		AlbumArtUrl: getBestFitSpotifyAlbumArtUrl(item.artImages(), thumbnailWidth, thumbnailHeight),
+	}
+}
+
+// SpotifyQueueHandler returns the next `limit` items in the user's queue. Names are
+// shortened to `maxLength` characters when it is set.
+func SpotifyQueueHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		token, err := client.getTokenForRequest(app, c)
+		if err != nil {
+			return err
+		}
+
+		limit := SPOTIFY_QUEUE_DEFAULT_LIMIT
+		limitRaw := c.QueryParam("limit")
+		if limitRaw != "" {
+			limit, err = strconv.Atoi(limitRaw)
+			if err != nil || limit <= 0 {
+				return apis.NewBadRequestError("limit must be a number greater than 0", nil)
+			}
+		}
+		if limit > SPOTIFY_QUEUE_MAX_LIMIT {
+			limit = SPOTIFY_QUEUE_MAX_LIMIT
+		}
+
+		maxLength := 0
+		maxLengthRaw := c.QueryParam("maxLength")
+		if maxLengthRaw != "" {
+			maxLength, err = strconv.Atoi(maxLengthRaw)
+			if err != nil {
+				return apis.NewBadRequestError("maxLength is not a valid number", nil)
+			}
+		}
+
+		thumbnailWidth, thumbnailHeight := parseSpotifyThumbnailSize(c)
+
+		statusCode, body, err := client.apiRequest(token, "GET", "/me/player/queue", nil, nil)
+		if err != nil {
+			return err
+		}
+		if statusCode >= 300 {
+			return apis.NewBadRequestError("Could not get spotify queue", nil)
+		}
+
+		var response struct {
+			Queue []RawSpotifyItem `json:"queue"`
+		}
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return apis.NewBadRequestError("Could not parse response", nil)
+		}
+
+		queue := []SpotifyQueueItem{}
+		for index, item := range response.Queue {
+			if index >= limit {
+				break
+			}
+			queue = append(queue, item.toQueueItem(index, maxLength, thumbnailWidth, thumbnailHeight))
+		}
+
+		return c.JSON(200, queue)
+	}
+}
+
+func (client *SpotifyClient) addToQueue(token *spotifyToken, uri string) error {
+	query := url.Values{}
+	query.Set("uri", uri)
+
+	return client.playerCommand(token, "POST", "/queue", query, nil)
+}
+
+// SpotifyAddToQueueHandler adds the track given by `track_id` to the end of the
+// user's queue, e.g. to replay an item from the recently played list.
+func SpotifyAddToQueueHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		trackId := c.QueryParam("track_id")
+		if trackId == "" {
+			return nil, apis.NewBadRequestError("track_id is required", nil)
+		}
+
+		return nil, client.addToQueue(token, "spotify:track:"+trackId)
+	})
+}
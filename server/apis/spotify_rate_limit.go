@@ -0,0 +1,71 @@
+package apis
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+const (
+	// used when spotify sends a 429 without a usable Retry-After header
+	SPOTIFY_DEFAULT_RETRY_AFTER_MS = 5000
+)
+
+func parseRetryAfter(retryAfterRaw string) time.Duration {
+	seconds, err := strconv.Atoi(retryAfterRaw)
+	if err != nil || seconds <= 0 {
+		return SPOTIFY_DEFAULT_RETRY_AFTER_MS * time.Millisecond
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func spotifyRateLimitedError(retryAfter time.Duration) *apis.ApiError {
+	err := spotifyReasonError(429, "Spotify is rate limiting requests", SPOTIFY_REASON_RATE_LIMITED)
+	err.Data["retry_after_ms"] = retryAfter.Milliseconds()
+	return err
+}
+
+// rateLimitDuration returns how long spotify asked to back off if err is a rate
+// limit error from apiRequest.
+func rateLimitDuration(err error) (time.Duration, bool) {
+	var apiErr *apis.ApiError
+	if !errors.As(err, &apiErr) || apiErr.Code != 429 {
+		return 0, false
+	}
+	retryAfterMs, _ := apiErr.Data["retry_after_ms"].(int64)
+	return time.Duration(retryAfterMs) * time.Millisecond, true
+}
+
+// rateLimitedFetch runs fetch unless spotify asked us to back off for this user.
+// While backing off, or when fetch itself gets rate limited, the last cached
+// snapshot is returned marked as stale. Without one the rate limit error is
+// returned.
+func (client *SpotifyClient) rateLimitedFetch(userId string, fetch func() (spotifyPlayerSnapshot, error)) (snapshot spotifyPlayerSnapshot, err error) {
+	if until, ok := client.rateLimitedUntil.Load(userId); ok {
+		remaining := time.Until(until.(time.Time))
+		if remaining > 0 {
+			return client.staleSnapshot(userId, spotifyRateLimitedError(remaining))
+		}
+		client.rateLimitedUntil.Delete(userId)
+	}
+
+	snapshot, err = fetch()
+	if retryAfter, limited := rateLimitDuration(err); limited {
+		client.rateLimitedUntil.Store(userId, time.Now().Add(retryAfter))
+		return client.staleSnapshot(userId, err)
+	}
+	return snapshot, err
+}
+
+func (client *SpotifyClient) staleSnapshot(userId string, rateLimitErr error) (snapshot spotifyPlayerSnapshot, err error) {
+	last, ok := client.lastPlayerState.Load(userId)
+	if !ok {
+		return snapshot, rateLimitErr
+	}
+
+	snapshot = last.(cachedPlayerSnapshot).snapshot
+	snapshot.Stale = true
+	return snapshot, nil
+}
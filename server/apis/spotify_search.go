@@ -0,0 +1,198 @@
+package apis
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+const (
+	// results per type
+	SPOTIFY_SEARCH_DEFAULT_LIMIT = 3
+	SPOTIFY_SEARCH_MAX_LIMIT     = 10
+)
+
+// in the order they are listed in the results
+var spotifySearchTypes = []string{"track", "album", "artist", "playlist"}
+
+var spotifySearchUriPattern = regexp.MustCompile(`^spotify:(track|album|artist|playlist):[A-Za-z0-9]+$`)
+
+type SpotifySearchResult struct {
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	Id    string `json:"id"`
+	Uri   string `json:"uri"`
+	Name  string `json:"name"`
+	// artists of tracks and albums, owner of playlists, empty for artists
+	Subtitle string `json:"subtitle"`
+	ImageUrl string `json:"image_url"`
+}
+
+type rawSpotifySearchItem struct {
+	Id      string                       `json:"id"`
+	Type    string                       `json:"type"`
+	Name    string                       `json:"name"`
+	Artists []SpotifyArtist              `json:"artists"`
+	Images  []SpotifyAlbumImagesResponse `json:"images"`
+
+	// only set for tracks
+	Album struct {
+		Images []SpotifyAlbumImagesResponse `json:"images"`
+	} `json:"album"`
+
+	// only set for playlists
+	Owner struct {
+		DisplayName string `json:"display_name"`
+	} `json:"owner"`
+}
+
+type rawSpotifySearchPage struct {
+	// spotify sometimes sends null entries, mostly for playlists
+	Items []*rawSpotifySearchItem `json:"items"`
+}
+
+func (item *rawSpotifySearchItem) toSearchResult(index, maxLength, thumbnailWidth, thumbnailHeight int) SpotifySearchResult {
+	images := item.Images
+	if item.Type == "track" {
+		images = item.Album.Images
+	}
+
+	subtitle := item.Owner.DisplayName
+	if len(item.Artists) > 0 {
+		artists := []string{}
+		for _, artist := range item.Artists {
+			artists = append(artists, artist.Name)
+		}
+		subtitle = strings.Join(artists, ", ")
+	}
+
+	return SpotifySearchResult{
+		Index:    index,
+		Type:     item.Type,
+		Id:       item.Id,
+		Uri:      "spotify:" + item.Type + ":" + item.Id,
+		Name:     truncateText(item.Name, maxLength),
+		Subtitle: truncateText(subtitle, maxLength),
+		ImageUrl: getBestFitSpotifyAlbumArtUrl(images, thumbnailWidth, thumbnailHeight),
+	}
+}
+
+// SpotifySearchHandler returns the top `limit` tracks, albums, artists and playlists
+// matching `q` as one list. Names are shortened to `maxLength` characters when it
+// is set. A result can be started with SpotifyPlaySearchResultHandler.
+func SpotifySearchHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		token, err := client.getTokenForRequest(app, c)
+		if err != nil {
+			return err
+		}
+
+		q := strings.TrimSpace(c.QueryParam("q"))
+		if q == "" {
+			return apis.NewBadRequestError("q is required", nil)
+		}
+
+		limit := SPOTIFY_SEARCH_DEFAULT_LIMIT
+		limitRaw := c.QueryParam("limit")
+		if limitRaw != "" {
+			limit, err = strconv.Atoi(limitRaw)
+			if err != nil || limit <= 0 {
+				return apis.NewBadRequestError("limit must be a number greater than 0", nil)
+			}
+		}
+		if limit > SPOTIFY_SEARCH_MAX_LIMIT {
+			limit = SPOTIFY_SEARCH_MAX_LIMIT
+		}
+
+		maxLength := 0
+		maxLengthRaw := c.QueryParam("maxLength")
+		if maxLengthRaw != "" {
+			maxLength, err = strconv.Atoi(maxLengthRaw)
+			if err != nil {
+				return apis.NewBadRequestError("maxLength is not a valid number", nil)
+			}
+		}
+
+		thumbnailWidth, thumbnailHeight := parseSpotifyThumbnailSize(c)
+
+		query := url.Values{}
+		query.Set("q", q)
+		query.Set("type", strings.Join(spotifySearchTypes, ","))
+		query.Set("limit", strconv.Itoa(limit))
+		// hides tracks that are not playable in the user's country
+		query.Set("market", "from_token")
+
+		statusCode, body, err := client.apiRequest(token, "GET", "/search", query, nil)
+		if err != nil {
+			return err
+		}
+		if statusCode >= 300 {
+			return apis.NewBadRequestError("Could not search spotify", nil)
+		}
+
+		var response struct {
+			Tracks    rawSpotifySearchPage `json:"tracks"`
+			Albums    rawSpotifySearchPage `json:"albums"`
+			Artists   rawSpotifySearchPage `json:"artists"`
+			Playlists rawSpotifySearchPage `json:"playlists"`
+		}
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return apis.NewBadRequestError("Could not parse response", nil)
+		}
+
+		results := []SpotifySearchResult{}
+		for _, page := range []rawSpotifySearchPage{response.Tracks, response.Albums, response.Artists, response.Playlists} {
+			for _, item := range page.Items {
+				if item == nil || item.Id == "" {
+					continue
+				}
+				results = append(results, item.toSearchResult(len(results), maxLength, thumbnailWidth, thumbnailHeight))
+			}
+		}
+
+		return c.JSON(200, results)
+	}
+}
+
+// SpotifyPlaySearchResultHandler starts the search result given by `uri`. With
+// `action=queue` a track is added to the queue instead.
+func SpotifyPlaySearchResultHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		uri := c.QueryParam("uri")
+		match := spotifySearchUriPattern.FindStringSubmatch(uri)
+		if match == nil {
+			return nil, apis.NewBadRequestError("uri must be a spotify track, album, artist or playlist uri", nil)
+		}
+		itemType := match[1]
+
+		switch c.QueryParam("action") {
+		case "", "play":
+			if itemType == "track" {
+				return nil, client.playerCommand(token, "PUT", "/play", nil, struct {
+					Uris []string `json:"uris"`
+				}{
+					Uris: []string{uri},
+				})
+			}
+			return nil, client.playerCommand(token, "PUT", "/play", nil, struct {
+				ContextUri string `json:"context_uri"`
+			}{
+				ContextUri: uri,
+			})
+		case "queue":
+			if itemType != "track" {
+				return nil, apis.NewBadRequestError("Only tracks can be added to the queue", nil)
+			}
+			return nil, client.addToQueue(token, uri)
+		default:
+			return nil, apis.NewBadRequestError("action must be play or queue", nil)
+		}
+	})
+}
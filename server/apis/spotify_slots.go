@@ -0,0 +1,65 @@
+package apis
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// SpotifyPlaySlotHandler starts playback of the context (playlist, album or artist)
+// the user mapped to slot `:n` in the spotify_slots collection. The `shuffle` query
+// parameter overrides the shuffle setting stored with the slot.
+func SpotifyPlaySlotHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return spotifyPlayerActionHandler(app, client, func(token *spotifyToken, c echo.Context) (func(*SpotifyCurrentlyPlaying), error) {
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+		slotNumber, err := strconv.Atoi(c.PathParam("n"))
+		if err != nil || slotNumber < 1 {
+			return nil, apis.NewBadRequestError("slot must be a number greater than 0", nil)
+		}
+
+		slot, err := app.Dao().FindFirstRecordByFilter(
+			"spotify_slots",
+			"user = {:user} && slot = {:slot}",
+			dbx.Params{"user": record.Id, "slot": slotNumber},
+		)
+		if err != nil {
+			return nil, apis.NewNotFoundError("Slot is not configured", nil)
+		}
+
+		shuffle := slot.GetBool("shuffle")
+		shuffleRaw := c.QueryParam("shuffle")
+		if shuffleRaw != "" {
+			shuffle, err = strconv.ParseBool(shuffleRaw)
+			if err != nil {
+				return nil, apis.NewBadRequestError("shuffle must be true or false", nil)
+			}
+		}
+
+		query := url.Values{}
+		query.Set("state", strconv.FormatBool(shuffle))
+
+		err = client.playerCommand(token, "PUT", "/shuffle", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		err = client.playerCommand(token, "PUT", "/play", nil, struct {
+			ContextUri string `json:"context_uri"`
+		}{
+			ContextUri: slot.GetString("context_uri"),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return func(currentlyPlaying *SpotifyCurrentlyPlaying) {
+			currentlyPlaying.ShuffleState = shuffle
+		}, nil
+	})
+}
@@ -0,0 +1,263 @@
+package apis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	// matches SPOTIFY_PLAYER_STATE_TTL_MS so polling devices and streams share requests
+	SPOTIFY_STREAM_POLL_MS = 1000
+	// comment lines keep proxies from closing a stream that has nothing to say
+	SPOTIFY_STREAM_KEEPALIVE_MS = 15000
+)
+
+type spotifyStreamEvent struct {
+	snapshot spotifyPlayerSnapshot
+	err      *apis.ApiError
+}
+
+// spotifyStreamKey holds the fields whose changes are pushed to subscribers
+type spotifyStreamKey struct {
+	idle          bool
+	itemId        string
+	isPlaying     bool
+	volumePercent int
+	shuffleState  bool
+	repeatState   string
+}
+
+func (snapshot *spotifyPlayerSnapshot) streamKey() spotifyStreamKey {
+	state := snapshot.State
+
+	key := spotifyStreamKey{
+		idle:         state.Idle,
+		itemId:       state.Item.Id,
+		isPlaying:    state.IsPlaying,
+		shuffleState: state.ShuffleState,
+		repeatState:  state.RepeatState,
+	}
+	if state.Device != nil {
+		key.volumePercent = state.Device.VolumePercent
+	}
+
+	return key
+}
+
+// spotifyStream polls the player state of one user on behalf of all their open
+// streams. Its fields are guarded by SpotifyClient.streamsMu.
+type spotifyStream struct {
+	userId      string
+	subscribers map[chan spotifyStreamEvent]struct{}
+	last        *spotifyStreamEvent
+	stop        chan struct{}
+}
+
+// subscribePlayerStream starts the user's poller if it is not running yet. The
+// latest known state is delivered right away, after that only changes.
+func (client *SpotifyClient) subscribePlayerStream(app *pocketbase.PocketBase, userId string) (events <-chan spotifyStreamEvent, unsubscribe func()) {
+	client.streamsMu.Lock()
+	defer client.streamsMu.Unlock()
+
+	if client.streams == nil {
+		client.streams = map[string]*spotifyStream{}
+	}
+
+	stream, ok := client.streams[userId]
+	if !ok {
+		stream = &spotifyStream{
+			userId:      userId,
+			subscribers: map[chan spotifyStreamEvent]struct{}{},
+			stop:        make(chan struct{}),
+		}
+		client.streams[userId] = stream
+		go client.pollPlayerStream(app, stream)
+	}
+
+	ch := make(chan spotifyStreamEvent, 1)
+	stream.subscribers[ch] = struct{}{}
+	if stream.last != nil {
+		ch <- *stream.last
+	}
+
+	return ch, func() {
+		client.unsubscribePlayerStream(stream, ch)
+	}
+}
+
+// unsubscribePlayerStream stops the poller when the last subscriber is gone
+func (client *SpotifyClient) unsubscribePlayerStream(stream *spotifyStream, ch chan spotifyStreamEvent) {
+	client.streamsMu.Lock()
+	defer client.streamsMu.Unlock()
+
+	// already removed when the poller ended on its own
+	if _, ok := stream.subscribers[ch]; !ok {
+		return
+	}
+
+	delete(stream.subscribers, ch)
+	if len(stream.subscribers) > 0 {
+		return
+	}
+
+	close(stream.stop)
+	if client.streams[stream.userId] == stream {
+		delete(client.streams, stream.userId)
+	}
+}
+
+func (client *SpotifyClient) publishPlayerStream(stream *spotifyStream, event spotifyStreamEvent) {
+	client.streamsMu.Lock()
+	defer client.streamsMu.Unlock()
+
+	stream.last = &event
+	for ch := range stream.subscribers {
+		// only the latest state matters, replace an event the subscriber has not read yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+// endPlayerStream sends a final error to the subscribers and closes their channels
+func (client *SpotifyClient) endPlayerStream(stream *spotifyStream, err *apis.ApiError) {
+	client.streamsMu.Lock()
+	defer client.streamsMu.Unlock()
+
+	for ch := range stream.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- spotifyStreamEvent{err: err}
+		close(ch)
+	}
+	stream.subscribers = nil
+
+	if client.streams[stream.userId] == stream {
+		delete(client.streams, stream.userId)
+	}
+}
+
+func (client *SpotifyClient) pollPlayerStream(app *pocketbase.PocketBase, stream *spotifyStream) {
+	var lastKey *spotifyStreamKey
+
+	for {
+		wait := SPOTIFY_STREAM_POLL_MS * time.Millisecond
+
+		// the user may disconnect spotify while the stream is open
+		user, err := app.Dao().FindRecordById("users", stream.userId)
+		if err != nil {
+			client.endPlayerStream(stream, apis.NewNotFoundError("User not found", nil))
+			return
+		}
+
+		token, err := client.getToken(app, user)
+		if errors.Is(err, ErrSpotifyNotConnected) || errors.Is(err, ErrSpotifyReconnectRequired) {
+			client.endPlayerStream(stream, spotifyTokenApiError(err))
+			return
+		}
+
+		// other errors are usually transient, subscribers keep the last state until the next poll
+		if err == nil {
+			var snapshot spotifyPlayerSnapshot
+			snapshot, err = client.loadPlayerSnapshot(stream.userId, newSpotifyToken(app, stream.userId, token))
+			if retryAfter, limited := rateLimitDuration(err); limited {
+				wait = retryAfter
+			} else if err == nil {
+				if key := snapshot.streamKey(); lastKey == nil || key != *lastKey {
+					lastKey = &key
+					client.publishPlayerStream(stream, spotifyStreamEvent{snapshot: snapshot})
+				}
+			}
+		}
+
+		select {
+		case <-stream.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func writeSpotifyStreamEvent(response *echo.Response, name string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(response, "event: %s\ndata: %s\n\n", name, payload)
+	if err != nil {
+		return err
+	}
+
+	response.Flush()
+	return nil
+}
+
+// SpotifyStreamHandler keeps the request open as a server-sent event stream. A
+// `now-playing` event carrying SpotifyCurrentlyPlaying is sent on connect and
+// whenever the item, play state, volume, shuffle or repeat state changes. The
+// stream ends with an `error` event when spotify is no longer connected.
+func SpotifyStreamHandler(app *pocketbase.PocketBase, client *SpotifyClient) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		// fail with a regular error response before the stream is started
+		_, err := client.getTokenForRequest(app, c)
+		if err != nil {
+			return err
+		}
+
+		thumbnailWidth, thumbnailHeight := parseSpotifyThumbnailSize(c)
+
+		record, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+
+		events, unsubscribe := client.subscribePlayerStream(app, record.Id)
+		defer unsubscribe()
+
+		response := c.Response()
+		response.Header().Set(echo.HeaderContentType, "text/event-stream")
+		response.Header().Set(echo.HeaderCacheControl, "no-cache")
+		response.Header().Set(echo.HeaderConnection, "keep-alive")
+		// stops nginx from buffering the events
+		response.Header().Set("X-Accel-Buffering", "no")
+		response.WriteHeader(200)
+		response.Flush()
+
+		keepalive := time.NewTicker(SPOTIFY_STREAM_KEEPALIVE_MS * time.Millisecond)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-keepalive.C:
+				_, err = io.WriteString(response, ": keepalive\n\n")
+				response.Flush()
+			case event, ok := <-events:
+				if !ok {
+					return nil
+				}
+				if event.err != nil {
+					err = writeSpotifyStreamEvent(response, "error", event.err)
+				} else {
+					err = writeSpotifyStreamEvent(response, "now-playing", event.snapshot.toCurrentlyPlaying(thumbnailWidth, thumbnailHeight))
+				}
+			}
+
+			// the device went away
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package apis
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"keyboard-api/apis/spotifytest"
+	_ "keyboard-api/migrations"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+)
+
+func TestMain(m *testing.M) {
+	// read once by credentialsKeyring
+	os.Setenv("CREDENTIALS_KEY", "test-credentials-key")
+	os.Exit(m.Run())
+}
+
+// newTestApp returns an app in a temporary data dir with all migrations applied.
+func newTestApp(t *testing.T) *pocketbase.PocketBase {
+	t.Helper()
+
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir()})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+
+	runner, err := migrate.NewRunner(app.DB(), migrations.AppMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+func newTestUser(t *testing.T, app *pocketbase.PocketBase) *models.Record {
+	t.Helper()
+
+	collection, err := app.Dao().FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := models.NewRecord(collection)
+	user.SetUsername("test_user")
+	user.SetEmail("test@example.com")
+	user.SetPassword("1234567890")
+	if err := app.Dao().SaveRecord(user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func newTestClient(t *testing.T) (*SpotifyClient, *spotifytest.Server) {
+	t.Helper()
+
+	server := spotifytest.NewServer()
+	t.Cleanup(server.Close)
+
+	client := &SpotifyClient{
+		AccountsUrl:  server.AccountsUrl(),
+		ApiUrl:       server.ApiUrl(),
+		ClientId:     spotifytest.CLIENT_ID,
+		ClientSecret: spotifytest.CLIENT_SECRET,
+		HttpClient:   server.Client(),
+	}
+
+	return client, server
+}
+
+// connectTestUser stores spotify credentials issued by server on the user.
+func connectTestUser(t *testing.T, app *pocketbase.PocketBase, server *spotifytest.Server, user *models.Record, expiresAt time.Time) {
+	t.Helper()
+
+	accessToken, refreshToken := server.IssueTokens()
+	err := WriteSpotifyCredentials(user, SpotifyCredentials{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		Scope:        spotifytest.SCOPE,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt.UnixMilli(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Dao().SaveRecord(user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// callHandler runs handler for a GET request to target as user, who may be nil.
+func callHandler(handler func(c echo.Context) error, target string, user *models.Record) (*httptest.ResponseRecorder, error) {
+	req := httptest.NewRequest("GET", target, nil)
+	rec := httptest.NewRecorder()
+
+	c := echo.New().NewContext(req, rec)
+	if user != nil {
+		c.Set(apis.ContextAuthRecordKey, user)
+	}
+
+	return rec, handler(c)
+}
+
+func TestSpotifyCallbackExchangesCodeOnce(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+
+	state, err := client.issueOauthState(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/spotify/callback?code=" + server.IssueCode() + "&state=" + state
+
+	rec, err := callHandler(SpotifyCallbackHandler(app, client), target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 307 {
+		t.Fatalf("expected a redirect, got %d", rec.Code)
+	}
+
+	user, err = app.Dao().FindRecordById("users", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := ReadSpotifyCredentials(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessToken == "" || creds.RefreshToken == "" {
+		t.Fatalf("expected stored tokens, got %+v", creds)
+	}
+
+	// the state nonce can only be redeemed once
+	rec, err = callHandler(SpotifyCallbackHandler(app, client), target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 400 {
+		t.Fatalf("expected a replayed state to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestSpotifyConcurrentRefreshesAreCoalesced(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+	connectTestUser(t, app, server, user, time.Now().Add(-time.Minute))
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	errs := make([]error, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], errs[i] = client.getToken(app, user)
+		}()
+	}
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if tokens[i] != tokens[0] {
+			t.Fatalf("expected every caller to get the same token")
+		}
+	}
+	if count := server.RefreshCount(); count != 1 {
+		t.Fatalf("expected 1 refresh, got %d", count)
+	}
+}
+
+func TestSpotifyRevokedRefreshTokenRequiresReconnect(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+	connectTestUser(t, app, server, user, time.Now().Add(-time.Minute))
+	server.RevokeRefreshTokens()
+
+	_, err := callHandler(SpotifyCurrentlyPlayingHandler(app, client), "/spotify/currently-playing", user)
+
+	var apiErr *apis.ApiError
+	if !errors.As(err, &apiErr) || apiErr.Code != 409 || apiErr.Data["reason"] != SPOTIFY_REASON_RECONNECT_REQUIRED {
+		t.Fatalf("expected a %s error, got %v", SPOTIFY_REASON_RECONNECT_REQUIRED, err)
+	}
+
+	user, err = app.Dao().FindRecordById("users", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := ReadSpotifyCredentials(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !creds.NeedsReauth {
+		t.Fatal("expected needs_reauth to be stored")
+	}
+}
+
+func getTestCurrentlyPlaying(t *testing.T, app *pocketbase.PocketBase, client *SpotifyClient, user *models.Record) SpotifyCurrentlyPlaying {
+	t.Helper()
+
+	rec, err := callHandler(SpotifyCurrentlyPlayingHandler(app, client), "/spotify/currently-playing", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var currentlyPlaying SpotifyCurrentlyPlaying
+	if err := json.Unmarshal(rec.Body.Bytes(), &currentlyPlaying); err != nil {
+		t.Fatal(err)
+	}
+	return currentlyPlaying
+}
+
+func TestSpotifyCurrentlyPlaying(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+	connectTestUser(t, app, server, user, time.Now().Add(time.Hour))
+	server.SetSaved("track1", true)
+
+	currentlyPlaying := getTestCurrentlyPlaying(t, app, client, user)
+	if currentlyPlaying.IsIdle || currentlyPlaying.TrackName != "First Track" || currentlyPlaying.MediaType != "track" || !currentlyPlaying.IsSaved {
+		t.Fatalf("unexpected payload %+v", currentlyPlaying)
+	}
+}
+
+func TestSpotifyCurrentlyPlayingWithoutActiveDeviceIsIdle(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+	connectTestUser(t, app, server, user, time.Now().Add(time.Hour))
+	server.SetPlayer(spotifytest.Player{Active: false})
+
+	currentlyPlaying := getTestCurrentlyPlaying(t, app, client, user)
+	if !currentlyPlaying.IsIdle || currentlyPlaying.TrackName != "" {
+		t.Fatalf("expected an idle payload, got %+v", currentlyPlaying)
+	}
+}
+
+func TestSpotifyRejectedAccessTokenIsRefreshed(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+	connectTestUser(t, app, server, user, time.Now().Add(time.Hour))
+
+	// still valid by our clock, but no longer accepted by spotify
+	server.ExpireAccessTokens()
+
+	currentlyPlaying := getTestCurrentlyPlaying(t, app, client, user)
+	if currentlyPlaying.TrackName != "First Track" {
+		t.Fatalf("expected the track after refreshing, got %+v", currentlyPlaying)
+	}
+	if count := server.RefreshCount(); count != 1 {
+		t.Fatalf("expected 1 refresh, got %d", count)
+	}
+}
+
+func TestSpotifyTokenEndpointFailuresKeepTheirReason(t *testing.T) {
+	tests := []struct {
+		status         int
+		expectedCode   int
+		expectedReason string
+	}{
+		{503, 502, SPOTIFY_REASON_UNAVAILABLE},
+		{429, 429, SPOTIFY_REASON_RATE_LIMITED},
+	}
+
+	for _, test := range tests {
+		app := newTestApp(t)
+		client, server := newTestClient(t)
+		user := newTestUser(t, app)
+		connectTestUser(t, app, server, user, time.Now().Add(-time.Minute))
+		server.FailTokenRequests(test.status)
+
+		_, err := callHandler(SpotifyCurrentlyPlayingHandler(app, client), "/spotify/currently-playing", user)
+
+		var apiErr *apis.ApiError
+		if !errors.As(err, &apiErr) || apiErr.Code != test.expectedCode || apiErr.Data["reason"] != test.expectedReason {
+			t.Errorf("%d: expected a %d %s error, got %v", test.status, test.expectedCode, test.expectedReason, err)
+		}
+	}
+}
+
+func TestSpotifyRejectedAccessTokenIsRefreshedOncePerRequest(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+	connectTestUser(t, app, server, user, time.Now().Add(time.Hour))
+	server.ExpireAccessTokens()
+
+	// the command and the state read afterwards share the renewed token
+	rec, err := callHandler(SpotifyNextHandler(app, client), "/spotify/player/next", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var currentlyPlaying SpotifyCurrentlyPlaying
+	if err := json.Unmarshal(rec.Body.Bytes(), &currentlyPlaying); err != nil {
+		t.Fatal(err)
+	}
+	if currentlyPlaying.TrackName != "Second Track" {
+		t.Fatalf("expected the next track, got %+v", currentlyPlaying)
+	}
+	if count := server.RefreshCount(); count != 1 {
+		t.Fatalf("expected 1 refresh, got %d", count)
+	}
+}
+
+func callTestPlayerAction(t *testing.T, handler func(c echo.Context) error, target string, user *models.Record) SpotifyCurrentlyPlaying {
+	t.Helper()
+
+	rec, err := callHandler(handler, target, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var currentlyPlaying SpotifyCurrentlyPlaying
+	if err := json.Unmarshal(rec.Body.Bytes(), &currentlyPlaying); err != nil {
+		t.Fatal(err)
+	}
+	return currentlyPlaying
+}
+
+func TestSpotifyPlayPause(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+	connectTestUser(t, app, server, user, time.Now().Add(time.Hour))
+
+	// caches the paused state, which the command has to invalidate
+	if getTestCurrentlyPlaying(t, app, client, user).IsPlaying {
+		t.Fatal("expected the player to start paused")
+	}
+
+	currentlyPlaying := callTestPlayerAction(t, SpotifyPlayPauseHandler(app, client), "/spotify/player/play-pause", user)
+	if !currentlyPlaying.IsPlaying || !server.Player().IsPlaying {
+		t.Fatalf("expected playback to start, got %+v", currentlyPlaying)
+	}
+
+	currentlyPlaying = callTestPlayerAction(t, SpotifyPlayPauseHandler(app, client), "/spotify/player/play-pause", user)
+	if currentlyPlaying.IsPlaying || server.Player().IsPlaying {
+		t.Fatalf("expected playback to pause, got %+v", currentlyPlaying)
+	}
+}
+
+func TestSpotifyVolumeDelta(t *testing.T) {
+	app := newTestApp(t)
+	client, server := newTestClient(t)
+	user := newTestUser(t, app)
+	connectTestUser(t, app, server, user, time.Now().Add(time.Hour))
+
+	// %2B is an escaped "+"
+	currentlyPlaying := callTestPlayerAction(t, SpotifyVolumeHandler(app, client), "/spotify/volume?delta=%2B10", user)
+	if currentlyPlaying.VolumePercent != 60 || server.Player().VolumePercent != 60 {
+		t.Fatalf("expected the volume to be 60, got %d", currentlyPlaying.VolumePercent)
+	}
+
+	// clamped to 0
+	currentlyPlaying = callTestPlayerAction(t, SpotifyVolumeHandler(app, client), "/spotify/volume?delta=-80", user)
+	if currentlyPlaying.VolumePercent != 0 || server.Player().VolumePercent != 0 {
+		t.Fatalf("expected the volume to be 0, got %d", currentlyPlaying.VolumePercent)
+	}
+}
@@ -0,0 +1,423 @@
+// Package spotifytest provides a fake of the spotify accounts service and Web API
+// so the spotify handlers can be exercised with `go test` and no network access.
+//
+//	server := spotifytest.NewServer()
+//	defer server.Close()
+//
+//	client := &apis.SpotifyClient{
+//		AccountsUrl:  server.AccountsUrl(),
+//		ApiUrl:       server.ApiUrl(),
+//		ClientId:     spotifytest.CLIENT_ID,
+//		ClientSecret: spotifytest.CLIENT_SECRET,
+//		HttpClient:   server.Client(),
+//	}
+//
+// It does not import the apis package so it can be used from its internal tests.
+package spotifytest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	CLIENT_ID     = "fake-client-id"
+	CLIENT_SECRET = "fake-client-secret"
+	SCOPE         = "user-read-playback-state user-modify-playback-state"
+)
+
+type Track struct {
+	Id         string
+	Name       string
+	ArtistId   string
+	ArtistName string
+	AlbumId    string
+	AlbumName  string
+	DurationMs int
+}
+
+// Player is the playback state of the fake user's single device.
+type Player struct {
+	// when false there is no active device, /me/player answers 204 and playback
+	// commands fail with 404
+	Active        bool
+	IsPlaying     bool
+	TrackIndex    int
+	ProgressMs    int
+	VolumePercent int
+	Shuffle       bool
+	Repeat        string
+}
+
+type Server struct {
+	*httptest.Server
+
+	// lifetime in seconds of issued access tokens
+	ExpiresIn int
+
+	mu            sync.Mutex
+	codes         map[string]bool
+	accessTokens  map[string]bool
+	refreshTokens map[string]bool
+	refreshCount  int
+	// when set, the token endpoint answers with this status instead
+	tokenStatus int
+
+	tracks []Track
+	saved  map[string]bool
+	player Player
+}
+
+// NewServer starts a fake spotify with a couple of tracks and an active, paused
+// player.
+func NewServer() *Server {
+	server := &Server{
+		ExpiresIn:     3600,
+		codes:         map[string]bool{},
+		accessTokens:  map[string]bool{},
+		refreshTokens: map[string]bool{},
+		saved:         map[string]bool{},
+		tracks: []Track{
+			{Id: "track1", Name: "First Track", ArtistId: "artist1", ArtistName: "First Artist", AlbumId: "album1", AlbumName: "First Album", DurationMs: 180000},
+			{Id: "track2", Name: "Second Track", ArtistId: "artist2", ArtistName: "Second Artist", AlbumId: "album2", AlbumName: "Second Album", DurationMs: 240000},
+			{Id: "track3", Name: "Third Track", ArtistId: "artist1", ArtistName: "First Artist", AlbumId: "album1", AlbumName: "First Album", DurationMs: 200000},
+		},
+		player: Player{
+			Active:        true,
+			VolumePercent: 50,
+			Repeat:        "off",
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/token", server.handleToken)
+	mux.HandleFunc("GET /v1/me/player", server.authorized(server.handlePlayer))
+	mux.HandleFunc("GET /v1/me/tracks/contains", server.authorized(server.handleTracksContains))
+	mux.HandleFunc("PUT /v1/me/player/play", server.playerCommand(func(player *Player, r *http.Request) int {
+		player.IsPlaying = true
+		return 204
+	}))
+	mux.HandleFunc("PUT /v1/me/player/pause", server.playerCommand(func(player *Player, r *http.Request) int {
+		player.IsPlaying = false
+		return 204
+	}))
+	mux.HandleFunc("POST /v1/me/player/next", server.playerCommand(func(player *Player, r *http.Request) int {
+		player.TrackIndex = (player.TrackIndex + 1) % len(server.tracks)
+		player.ProgressMs = 0
+		return 204
+	}))
+	mux.HandleFunc("POST /v1/me/player/previous", server.playerCommand(func(player *Player, r *http.Request) int {
+		player.TrackIndex = (player.TrackIndex + len(server.tracks) - 1) % len(server.tracks)
+		player.ProgressMs = 0
+		return 204
+	}))
+	mux.HandleFunc("PUT /v1/me/player/volume", server.playerCommand(func(player *Player, r *http.Request) int {
+		volume, err := strconv.Atoi(r.URL.Query().Get("volume_percent"))
+		if err != nil || volume < 0 || volume > 100 {
+			return 400
+		}
+		player.VolumePercent = volume
+		return 204
+	}))
+	mux.HandleFunc("PUT /v1/me/player/shuffle", server.playerCommand(func(player *Player, r *http.Request) int {
+		shuffle, err := strconv.ParseBool(r.URL.Query().Get("state"))
+		if err != nil {
+			return 400
+		}
+		player.Shuffle = shuffle
+		return 204
+	}))
+	mux.HandleFunc("PUT /v1/me/player/repeat", server.playerCommand(func(player *Player, r *http.Request) int {
+		repeat := r.URL.Query().Get("state")
+		if repeat != "off" && repeat != "context" && repeat != "track" {
+			return 400
+		}
+		player.Repeat = repeat
+		return 204
+	}))
+	mux.HandleFunc("PUT /v1/me/player/seek", server.playerCommand(func(player *Player, r *http.Request) int {
+		position, err := strconv.Atoi(r.URL.Query().Get("position_ms"))
+		if err != nil || position < 0 {
+			return 400
+		}
+		player.ProgressMs = position
+		return 204
+	}))
+
+	server.Server = httptest.NewServer(mux)
+	return server
+}
+
+// AccountsUrl is the base url of the fake accounts service.
+func (server *Server) AccountsUrl() string {
+	return server.URL
+}
+
+// ApiUrl is the base url of the fake Web API.
+func (server *Server) ApiUrl() string {
+	return server.URL + "/v1"
+}
+
+func randomToken() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// IssueCode returns an authorization code that can be exchanged for tokens once,
+// as if the user had just approved the app.
+func (server *Server) IssueCode() string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	code := randomToken()
+	server.codes[code] = true
+	return code
+}
+
+// IssueTokens returns a valid access and refresh token pair without going through
+// the authorization flow.
+func (server *Server) IssueTokens() (accessToken, refreshToken string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	accessToken = randomToken()
+	refreshToken = randomToken()
+	server.accessTokens[accessToken] = true
+	server.refreshTokens[refreshToken] = true
+	return accessToken, refreshToken
+}
+
+// ExpireAccessTokens invalidates every issued access token, forcing a refresh.
+func (server *Server) ExpireAccessTokens() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.accessTokens = map[string]bool{}
+}
+
+// RevokeRefreshTokens invalidates every issued refresh token, as if the user
+// removed the app from their spotify account.
+func (server *Server) RevokeRefreshTokens() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.refreshTokens = map[string]bool{}
+}
+
+// FailTokenRequests makes the token endpoint answer every request with status,
+// e.g. 503 for an outage or 429 for a rate limit. Zero restores normal behavior.
+func (server *Server) FailTokenRequests(status int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.tokenStatus = status
+}
+
+// RefreshCount returns how many refresh_token grants were handled.
+func (server *Server) RefreshCount() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.refreshCount
+}
+
+func (server *Server) Player() Player {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.player
+}
+
+func (server *Server) SetPlayer(player Player) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.player = player
+}
+
+func (server *Server) SetSaved(trackId string, saved bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.saved[trackId] = saved
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"status":  status,
+			"message": message,
+		},
+	})
+}
+
+func (server *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	expectedAuthorization := "Basic " + base64.StdEncoding.EncodeToString([]byte(CLIENT_ID+":"+CLIENT_SECRET))
+	if r.Header.Get("Authorization") != expectedAuthorization {
+		writeJSON(w, 400, map[string]string{"error": "invalid_client", "error_description": "Invalid client"})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.tokenStatus != 0 {
+		if server.tokenStatus == 429 {
+			w.Header().Set("Retry-After", "5")
+		}
+		writeJSON(w, server.tokenStatus, map[string]string{"error": "server_error"})
+		return
+	}
+
+	response := map[string]any{
+		"token_type": "Bearer",
+		"expires_in": server.ExpiresIn,
+		"scope":      SCOPE,
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		if !server.codes[code] {
+			writeJSON(w, 400, map[string]string{"error": "invalid_grant", "error_description": "Invalid authorization code"})
+			return
+		}
+		delete(server.codes, code)
+
+		refreshToken := randomToken()
+		server.refreshTokens[refreshToken] = true
+		response["refresh_token"] = refreshToken
+	case "refresh_token":
+		if !server.refreshTokens[r.PostForm.Get("refresh_token")] {
+			writeJSON(w, 400, map[string]string{"error": "invalid_grant", "error_description": "Refresh token revoked"})
+			return
+		}
+		server.refreshCount++
+	default:
+		writeJSON(w, 400, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	accessToken := randomToken()
+	server.accessTokens[accessToken] = true
+	response["access_token"] = accessToken
+
+	writeJSON(w, 200, response)
+}
+
+func (server *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		server.mu.Lock()
+		valid := server.accessTokens[token]
+		server.mu.Unlock()
+
+		if !valid {
+			writeApiError(w, 401, "The access token expired")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (server *Server) playerCommand(command func(player *Player, r *http.Request) int) http.HandlerFunc {
+	return server.authorized(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		if !server.player.Active {
+			writeApiError(w, 404, "Player command failed: No active device found")
+			return
+		}
+
+		player := server.player
+		status := command(&player, r)
+		if status >= 300 {
+			writeApiError(w, status, "Invalid request")
+			return
+		}
+
+		server.player = player
+		w.WriteHeader(status)
+	})
+}
+
+func (server *Server) handlePlayer(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if !server.player.Active {
+		w.WriteHeader(204)
+		return
+	}
+
+	track := server.tracks[server.player.TrackIndex]
+
+	writeJSON(w, 200, map[string]any{
+		"device": map[string]any{
+			"id":              "device1",
+			"is_active":       true,
+			"is_restricted":   false,
+			"name":            "Fake Speaker",
+			"type":            "Speaker",
+			"volume_percent":  server.player.VolumePercent,
+			"supports_volume": true,
+		},
+		"is_playing":             server.player.IsPlaying,
+		"progress_ms":            server.player.ProgressMs,
+		"shuffle_state":          server.player.Shuffle,
+		"repeat_state":           server.player.Repeat,
+		"currently_playing_type": "track",
+		"item": map[string]any{
+			"id":          track.Id,
+			"type":        "track",
+			"name":        track.Name,
+			"popularity":  50,
+			"duration_ms": track.DurationMs,
+			"album": map[string]any{
+				"id":   track.AlbumId,
+				"name": track.AlbumName,
+				"images": []map[string]any{
+					{"url": server.URL + "/images/" + track.AlbumId + "-640.jpg", "width": 640, "height": 640},
+					{"url": server.URL + "/images/" + track.AlbumId + "-300.jpg", "width": 300, "height": 300},
+					{"url": server.URL + "/images/" + track.AlbumId + "-64.jpg", "width": 64, "height": 64},
+				},
+			},
+			"artists": []map[string]any{
+				{"id": track.ArtistId, "name": track.ArtistName},
+			},
+		},
+	})
+}
+
+func (server *Server) handleTracksContains(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	saved := []bool{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		saved = append(saved, server.saved[id])
+	}
+
+	writeJSON(w, 200, saved)
+}
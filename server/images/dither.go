@@ -0,0 +1,124 @@
+package images
+
+import (
+	"fmt"
+)
+
+type DitherMode string
+
+const (
+	DitherFloydSteinberg DitherMode = "floyd-steinberg"
+	DitherAtkinson       DitherMode = "atkinson"
+	// ordered dithering with an 8x8 Bayer matrix, avoids the crawling patterns
+	// error diffusion causes between frames
+	DitherBayer DitherMode = "bayer"
+	// no dithering, with FormatMono pixels are compared with Options.Threshold,
+	// grayscale pixels get the nearest level
+	DitherThreshold DitherMode = "threshold"
+)
+
+func ParseDitherMode(ditherRaw string) (DitherMode, error) {
+	dither := DitherMode(ditherRaw)
+	switch dither {
+	case "":
+		return DitherFloydSteinberg, nil
+	case DitherFloydSteinberg, DitherAtkinson, DitherBayer, DitherThreshold:
+		return dither, nil
+	}
+	return "", fmt.Errorf("unknown dither mode %q", ditherRaw)
+}
+
+const DEFAULT_THRESHOLD = 128
+
+type diffusionWeight struct {
+	dx, dy int
+	weight float32
+}
+
+var floydSteinbergWeights = []diffusionWeight{
+	{1, 0, 7.0 / 16}, {-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16},
+}
+
+// Atkinson only spreads 6/8 of the error, which keeps more contrast on small displays
+var atkinsonWeights = []diffusionWeight{
+	{1, 0, 1.0 / 8}, {2, 0, 1.0 / 8}, {-1, 1, 1.0 / 8}, {0, 1, 1.0 / 8}, {1, 1, 1.0 / 8}, {0, 2, 1.0 / 8},
+}
+
+var bayerMatrix = [8][8]float32{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// quantize reduces the luminance values of a width x height image to the given
+// number of evenly spaced levels and returns the level of each pixel, 0 being black.
+// threshold only applies to DitherThreshold with 2 levels.
+func quantize(gray []float32, width, height, levels int, dither DitherMode, threshold int) []uint8 {
+	step := 255 / float32(levels-1)
+	nearest := func(value float32) uint8 {
+		level := int(value/step + 0.5)
+		if level < 0 {
+			return 0
+		}
+		if level > levels-1 {
+			return uint8(levels - 1)
+		}
+		return uint8(level)
+	}
+
+	out := make([]uint8, len(gray))
+
+	switch dither {
+	case DitherFloydSteinberg, DitherAtkinson, "":
+		weights := floydSteinbergWeights
+		if dither == DitherAtkinson {
+			weights = atkinsonWeights
+		}
+
+		// the error is spread over a copy so gray stays untouched
+		values := append([]float32(nil), gray...)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				value := values[y*width+x]
+				level := nearest(value)
+				out[y*width+x] = level
+
+				quantError := value - float32(level)*step
+				for _, w := range weights {
+					nx, ny := x+w.dx, y+w.dy
+					if nx < 0 || nx >= width || ny >= height {
+						continue
+					}
+					values[ny*width+nx] += quantError * w.weight
+				}
+			}
+		}
+	case DitherBayer:
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				offset := ((bayerMatrix[y%8][x%8]+0.5)/64 - 0.5) * step
+				out[y*width+x] = nearest(gray[y*width+x] + offset)
+			}
+		}
+	default:
+		if threshold <= 0 {
+			threshold = DEFAULT_THRESHOLD
+		}
+		for i, value := range gray {
+			if levels == 2 {
+				if value >= float32(threshold) {
+					out[i] = 1
+				}
+				continue
+			}
+			out[i] = nearest(value)
+		}
+	}
+
+	return out
+}
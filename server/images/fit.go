@@ -0,0 +1,196 @@
+package images
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+type FitMode string
+
+const (
+	// fills the target and crops what does not fit, see Options.Anchor
+	FitCover FitMode = "cover"
+	// scales the whole image into the target and fills the rest with Options.Background
+	FitContain FitMode = "contain"
+	// scales the image to the target without keeping the aspect ratio
+	FitStretch FitMode = "stretch"
+)
+
+func ParseFitMode(fitRaw string) (FitMode, error) {
+	fit := FitMode(fitRaw)
+	switch fit {
+	case "":
+		return FitCover, nil
+	case FitCover, FitContain, FitStretch:
+		return fit, nil
+	}
+	return "", fmt.Errorf("unknown fit mode %q", fitRaw)
+}
+
+// Anchor is the part of the image that is kept by FitCover, or the side the
+// image is moved to by FitContain
+type Anchor string
+
+const (
+	AnchorCenter      Anchor = "center"
+	AnchorTop         Anchor = "top"
+	AnchorBottom      Anchor = "bottom"
+	AnchorLeft        Anchor = "left"
+	AnchorRight       Anchor = "right"
+	AnchorTopLeft     Anchor = "top-left"
+	AnchorTopRight    Anchor = "top-right"
+	AnchorBottomLeft  Anchor = "bottom-left"
+	AnchorBottomRight Anchor = "bottom-right"
+	// keeps the most detailed and colorful part of the image with FitCover, see
+	// smartCropPosition. FitContain centers the image.
+	AnchorSmart Anchor = "smart"
+)
+
+func ParseAnchor(anchorRaw string) (Anchor, error) {
+	anchor := Anchor(anchorRaw)
+	switch anchor {
+	case "":
+		return AnchorCenter, nil
+	case AnchorCenter, AnchorTop, AnchorBottom, AnchorLeft, AnchorRight,
+		AnchorTopLeft, AnchorTopRight, AnchorBottomLeft, AnchorBottomRight, AnchorSmart:
+		return anchor, nil
+	}
+	return "", fmt.Errorf("unknown anchor %q", anchorRaw)
+}
+
+// position returns where the anchor lies from 0 (left/top) to 1 (right/bottom)
+func (anchor Anchor) position() (x, y float64) {
+	x, y = 0.5, 0.5
+	switch anchor {
+	case AnchorTop, AnchorTopLeft, AnchorTopRight:
+		y = 0
+	case AnchorBottom, AnchorBottomLeft, AnchorBottomRight:
+		y = 1
+	}
+	switch anchor {
+	case AnchorLeft, AnchorTopLeft, AnchorBottomLeft:
+		x = 0
+	case AnchorRight, AnchorTopRight, AnchorBottomRight:
+		x = 1
+	}
+	return x, y
+}
+
+// ParseColor reads a hex color like ff8800 or #ff8800
+func ParseColor(colorRaw string) (color.RGBA, error) {
+	rgb, err := hex.DecodeString(strings.TrimPrefix(colorRaw, "#"))
+	if err != nil || len(rgb) != 3 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", colorRaw)
+	}
+	return color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255}, nil
+}
+
+// coverCrop returns the largest part of img with the aspect ratio of the target
+func coverCrop(img image.Image, width, height int, anchor Anchor) image.Rectangle {
+	bounds := img.Bounds()
+	imgWidth, imgHeight := bounds.Dx(), bounds.Dy()
+
+	desiredAspectRatio := float64(width) / float64(height)
+	currentAspectRatio := float64(imgWidth) / float64(imgHeight)
+
+	cropWidth, cropHeight := imgWidth, imgHeight
+	if currentAspectRatio < desiredAspectRatio {
+		// Image is too tall, crop y
+		cropHeight = int(float64(imgWidth) / desiredAspectRatio)
+	} else if currentAspectRatio > desiredAspectRatio {
+		// Image is too wide, crop x
+		cropWidth = int(float64(imgHeight) * desiredAspectRatio)
+	}
+
+	anchorX, anchorY := anchor.position()
+	if anchor == AnchorSmart {
+		anchorX, anchorY = smartCropPosition(img, cropWidth, cropHeight)
+	}
+
+	left := bounds.Min.X + int(float64(imgWidth-cropWidth)*anchorX)
+	top := bounds.Min.Y + int(float64(imgHeight-cropHeight)*anchorY)
+	return image.Rect(left, top, left+cropWidth, top+cropHeight)
+}
+
+// containRect returns where an image of the given size is drawn inside the target
+func containRect(imgWidth, imgHeight, width, height int, anchor Anchor) image.Rectangle {
+	anchorX, anchorY := anchor.position()
+
+	scale := min(float64(width)/float64(imgWidth), float64(height)/float64(imgHeight))
+	drawWidth := max(1, int(float64(imgWidth)*scale+0.5))
+	drawHeight := max(1, int(float64(imgHeight)*scale+0.5))
+
+	left := int(float64(width-drawWidth) * anchorX)
+	top := int(float64(height-drawHeight) * anchorY)
+	return image.Rect(left, top, left+drawWidth, top+drawHeight)
+}
+
+// fit scales img to width x height as described by options.Fit
+func fit(img image.Image, width, height int, options Options) *image.RGBA {
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	if options.Background.A > 0 {
+		draw.Draw(resized, resized.Bounds(), image.NewUniform(options.Background), image.Point{}, draw.Src)
+	}
+
+	src := img.Bounds()
+	dst := resized.Bounds()
+	switch options.Fit {
+	case FitStretch:
+	case FitContain:
+		dst = containRect(src.Dx(), src.Dy(), width, height, options.Anchor)
+	default:
+		src = coverCrop(img, width, height, options.Anchor)
+	}
+
+	draw.CatmullRom.Scale(resized, dst, img, src, draw.Over, nil)
+
+	return resized
+}
+
+// orient rotates img clockwise by options.Rotate degrees and then mirrors it
+func orient(img *image.RGBA, options Options) *image.RGBA {
+	if options.Rotate == 0 && !options.MirrorHorizontal && !options.MirrorVertical {
+		return img
+	}
+
+	srcWidth, srcHeight := GetImageSize(img)
+	width, height := srcWidth, srcHeight
+	if options.Rotate == 90 || options.Rotate == 270 {
+		width, height = srcHeight, srcWidth
+	}
+
+	oriented := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dx, dy := x, y
+			if options.MirrorHorizontal {
+				dx = width - 1 - dx
+			}
+			if options.MirrorVertical {
+				dy = height - 1 - dy
+			}
+
+			var sx, sy int
+			switch options.Rotate {
+			case 90:
+				sx, sy = dy, srcHeight-1-dx
+			case 180:
+				sx, sy = srcWidth-1-dx, srcHeight-1-dy
+			case 270:
+				sx, sy = srcWidth-1-dy, dx
+			default:
+				sx, sy = dx, dy
+			}
+
+			srcOffset := img.PixOffset(img.Rect.Min.X+sx, img.Rect.Min.Y+sy)
+			copy(oriented.Pix[oriented.PixOffset(x, y):][:4], img.Pix[srcOffset:srcOffset+4])
+		}
+	}
+
+	return oriented
+}
@@ -0,0 +1,153 @@
+package images
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCoverCrop(t *testing.T) {
+	tests := []struct {
+		width, height int
+		anchor        Anchor
+		expected      image.Rectangle
+	}{
+		// a wide image keeps its full height, a tall one its full width
+		{100, 50, AnchorCenter, image.Rect(25, 0, 75, 50)},
+		{50, 100, AnchorCenter, image.Rect(0, 25, 50, 75)},
+		{100, 50, AnchorLeft, image.Rect(0, 0, 50, 50)},
+		{100, 50, AnchorRight, image.Rect(50, 0, 100, 50)},
+		{50, 100, AnchorTop, image.Rect(0, 0, 50, 50)},
+		{50, 100, AnchorBottom, image.Rect(0, 50, 50, 100)},
+		{50, 100, AnchorBottomRight, image.Rect(0, 50, 50, 100)},
+	}
+
+	for _, test := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, test.width, test.height))
+		if crop := coverCrop(img, 10, 10, test.anchor); crop != test.expected {
+			t.Errorf("%dx%d %s: expected %v, got %v", test.width, test.height, test.anchor, test.expected, crop)
+		}
+	}
+}
+
+func TestCoverCropToNonSquareTarget(t *testing.T) {
+	// the crop is sized from the side that is kept, a 2:1 crop of a 50x100 image
+	// is 50x25 and not 50x50, and of a 200x50 image 100x50 and not 400x50
+	img := image.NewRGBA(image.Rect(0, 0, 50, 100))
+	expected := image.Rect(0, 37, 50, 62)
+	if crop := coverCrop(img, 20, 10, AnchorCenter); crop != expected {
+		t.Errorf("expected %v, got %v", expected, crop)
+	}
+
+	img = image.NewRGBA(image.Rect(0, 0, 200, 50))
+	expected = image.Rect(50, 0, 150, 50)
+	if crop := coverCrop(img, 20, 10, AnchorCenter); crop != expected {
+		t.Errorf("expected %v, got %v", expected, crop)
+	}
+}
+
+func TestContainRect(t *testing.T) {
+	tests := []struct {
+		anchor   Anchor
+		expected image.Rectangle
+	}{
+		{AnchorCenter, image.Rect(0, 2, 10, 7)},
+		{AnchorTop, image.Rect(0, 0, 10, 5)},
+		{AnchorBottom, image.Rect(0, 5, 10, 10)},
+	}
+
+	for _, test := range tests {
+		if rect := containRect(100, 50, 10, 10, test.anchor); rect != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.anchor, test.expected, rect)
+		}
+	}
+}
+
+func TestFitContainFillsBackground(t *testing.T) {
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	img := newTestImage([][]color.RGBA{
+		{red, red, red, red},
+		{red, red, red, red},
+	})
+
+	resized := fit(img, 4, 4, Options{Fit: FitContain, Anchor: AnchorCenter, Background: blue})
+
+	expected := []color.RGBA{blue, red, red, blue}
+	for y, pixel := range expected {
+		for x := 0; x < 4; x++ {
+			if actual := resized.RGBAAt(x, y); actual != pixel {
+				t.Fatalf("(%d, %d): expected %v, got %v", x, y, pixel, actual)
+			}
+		}
+	}
+}
+
+func TestFitStretch(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	img := newTestImage([][]color.RGBA{
+		{red, red, red, red},
+		{red, red, red, red},
+	})
+
+	// the image fills the whole target instead of leaving bars
+	resized := fit(img, 4, 4, Options{Fit: FitStretch, Background: color.RGBA{0, 0, 255, 255}})
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if actual := resized.RGBAAt(x, y); actual != red {
+				t.Fatalf("(%d, %d): expected %v, got %v", x, y, red, actual)
+			}
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// pixels are numbered in their red channel
+	//   1 2 3
+	//   4 5 6
+	rows := [][]color.RGBA{}
+	for y := 0; y < 2; y++ {
+		row := []color.RGBA{}
+		for x := 0; x < 3; x++ {
+			row = append(row, color.RGBA{uint8(y*3 + x + 1), 0, 0, 255})
+		}
+		rows = append(rows, row)
+	}
+	img := newTestImage(rows)
+
+	tests := []struct {
+		options  Options
+		expected [][]uint8
+	}{
+		{Options{Rotate: 90}, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{Options{Rotate: 180}, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{Options{Rotate: 270}, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+		{Options{MirrorHorizontal: true}, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{Options{MirrorVertical: true}, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{Options{Rotate: 90, MirrorVertical: true}, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+	}
+
+	for _, test := range tests {
+		oriented := orient(img, test.options)
+
+		actual := [][]uint8{}
+		for y := 0; y < oriented.Rect.Dy(); y++ {
+			row := []uint8{}
+			for x := 0; x < oriented.Rect.Dx(); x++ {
+				row = append(row, oriented.RGBAAt(x, y).R)
+			}
+			actual = append(actual, row)
+		}
+
+		if len(actual) != len(test.expected) {
+			t.Errorf("%+v: expected %v, got %v", test.options, test.expected, actual)
+			continue
+		}
+		for y := range actual {
+			if !bytes.Equal(actual[y], test.expected[y]) {
+				t.Errorf("%+v: expected %v, got %v", test.options, test.expected, actual)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+)
+
+type NibbleOrder string
+
+const (
+	// the leftmost pixel of each byte is stored in its highest bits
+	NibbleOrderMsb NibbleOrder = "msb"
+	// the leftmost pixel of each byte is stored in its lowest bits
+	NibbleOrderLsb NibbleOrder = "lsb"
+)
+
+func ParseNibbleOrder(nibbleOrderRaw string) (NibbleOrder, error) {
+	nibbleOrder := NibbleOrder(nibbleOrderRaw)
+	switch nibbleOrder {
+	case "":
+		return NibbleOrderMsb, nil
+	case NibbleOrderMsb, NibbleOrderLsb:
+		return nibbleOrder, nil
+	}
+	return "", fmt.Errorf("unknown nibble order %q", nibbleOrderRaw)
+}
+
+// srgbToLinear maps an 8 bit sRGB channel to linear light from 0 to 1
+var srgbToLinear = func() (table [256]float64) {
+	for i := range table {
+		value := float64(i) / 255
+		if value <= 0.04045 {
+			table[i] = value / 12.92
+		} else {
+			table[i] = math.Pow((value+0.055)/1.055, 2.4)
+		}
+	}
+	return table
+}()
+
+func linearToSrgb(value float64) float64 {
+	if value <= 0.0031308 {
+		return value * 12.92
+	}
+	return 1.055*math.Pow(value, 1/2.4) - 0.055
+}
+
+// luminance returns the brightness of each pixel from 0 to 255, row by row. The
+// channels are weighted in linear light and the result is gamma encoded again so
+// evenly spaced gray levels also look evenly spaced.
+func luminance(img *image.RGBA) []float32 {
+	bounds := img.Bounds()
+	gray := make([]float32, 0, bounds.Dx()*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pixels := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			linear := 0.2126*srgbToLinear[pixels[x*4]] + 0.7152*srgbToLinear[pixels[x*4+1]] + 0.0722*srgbToLinear[pixels[x*4+2]]
+			gray = append(gray, float32(linearToSrgb(linear)*255))
+		}
+	}
+
+	return gray
+}
+
+// writeGray writes row by row with every row starting on a new byte, 0 is black
+func writeGray(writer io.Writer, img *image.RGBA, options Options) error {
+	bitsPerPixel := 2
+	if options.Format == FormatGray4 {
+		bitsPerPixel = 4
+	}
+	pixelsPerByte := 8 / bitsPerPixel
+
+	width, height := GetImageSize(img)
+	levels := quantize(luminance(img), width, height, 1<<bitsPerPixel, options.Dither, options.Threshold)
+
+	rowBytes := (width + pixelsPerByte - 1) / pixelsPerByte
+	packed := make([]byte, rowBytes*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			slot := x % pixelsPerByte
+			if options.NibbleOrder != NibbleOrderLsb {
+				slot = pixelsPerByte - 1 - slot
+			}
+			packed[y*rowBytes+x/pixelsPerByte] |= levels[y*width+x] << (slot * bitsPerPixel)
+		}
+	}
+
+	_, err := writer.Write(packed)
+	return err
+}
@@ -0,0 +1,72 @@
+package images
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+)
+
+func TestWriteGrayNibbleOrder(t *testing.T) {
+	img := newTestImage([][]color.RGBA{
+		{gray(0), gray(85), gray(170), gray(255)},
+	})
+
+	tests := []struct {
+		format      PixelFormat
+		nibbleOrder NibbleOrder
+		expected    []byte
+	}{
+		{FormatGray2, NibbleOrderMsb, []byte{0x1b}},
+		{FormatGray2, NibbleOrderLsb, []byte{0xe4}},
+		{FormatGray4, NibbleOrderMsb, []byte{0x05, 0xaf}},
+		{FormatGray4, NibbleOrderLsb, []byte{0x50, 0xfa}},
+	}
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		err := writeGray(&b, img, Options{Format: test.format, Dither: DitherThreshold, NibbleOrder: test.nibbleOrder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), test.expected) {
+			t.Errorf("%s %s: expected % x, got % x", test.format, test.nibbleOrder, test.expected, b.Bytes())
+		}
+	}
+}
+
+func TestLuminanceIsWeightedInLinearLight(t *testing.T) {
+	img := newTestImage([][]color.RGBA{
+		{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, gray(128)},
+	})
+
+	// Rec.601 weights applied to the gamma encoded values would give 76, 150 and
+	// 29 for the pure colors
+	expected := []int{127, 220, 76, 128}
+
+	for i, value := range luminance(img) {
+		if rounded := int(value + 0.5); rounded != expected[i] {
+			t.Errorf("pixel %d: expected %d, got %v", i, expected[i], value)
+		}
+	}
+}
+
+func TestQuantizeGrayDither(t *testing.T) {
+	ramp := []float32{0, 32, 64, 96, 128, 160, 192, 224}
+
+	tests := []struct {
+		dither   DitherMode
+		expected []uint8
+	}{
+		{DitherFloydSteinberg, []uint8{0, 0, 1, 1, 2, 2, 2, 3}},
+		{DitherAtkinson, []uint8{0, 0, 1, 1, 1, 2, 2, 3}},
+		{DitherBayer, []uint8{0, 0, 0, 1, 1, 2, 2, 3}},
+		{DitherThreshold, []uint8{0, 0, 1, 1, 2, 2, 2, 3}},
+	}
+
+	for _, test := range tests {
+		levels := quantize(ramp, 8, 1, 4, test.dither, 0)
+		if !bytes.Equal(levels, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.dither, test.expected, levels)
+		}
+	}
+}
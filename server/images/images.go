@@ -2,43 +2,59 @@ package images
 
 import (
 	"image"
+	"image/color"
 	"io"
 
 	"golang.org/x/image/bmp"
-	"golang.org/x/image/draw"
 )
 
+// Options controls how ToBitmap encodes the image. The zero value writes a BMP.
+type Options struct {
+	Format PixelFormat
+
+	Fit    FitMode
+	Anchor Anchor
+	// fills the bars left by FitContain and transparent pixels, the zero value
+	// leaves them transparent
+	Background color.RGBA
+	// clockwise degrees, one of 0, 90, 180 or 270
+	Rotate int
+	// applied after the rotation
+	MirrorHorizontal bool
+	MirrorVertical   bool
+
+	// only used by FormatMono, FormatGray2 and FormatGray4
+	Dither DitherMode
+	// 1 to 255, pixels at least this bright are lit with DitherThreshold, 0 uses DEFAULT_THRESHOLD
+	Threshold int
+	Packing   MonoPacking
+	// only used by FormatGray2 and FormatGray4
+	NibbleOrder NibbleOrder
+}
+
 func GetImageSize(img image.Image) (int, int) {
 	bounds := img.Bounds()
 	return bounds.Dx(), bounds.Dy()
 }
 
-func ToBitmap(img image.Image, width, height int, writer *io.Writer) (err error) {
-
-	imgWidth, imgHeight := GetImageSize(img)
-
-	// First we crop to the correct aspect ratio
-
-	desiredAspectRatio := float64(width) / float64(height)
-	currentAspectRatio := float64(imgWidth) / float64(imgHeight)
+func ToBitmap(img image.Image, width, height int, writer *io.Writer, options Options) (err error) {
 
-	crop := img.Bounds()
-	if currentAspectRatio < desiredAspectRatio {
-		// Image is too wide, crop y
-		cropHeight := int(float64(imgHeight) / desiredAspectRatio)
-		crop = image.Rect(0, (imgHeight-cropHeight)/2, imgWidth, (imgHeight-cropHeight)/2+cropHeight)
-	} else if currentAspectRatio > desiredAspectRatio {
-		// Image is too narrow, crop x
-		cropWidth := int(float64(imgWidth) * desiredAspectRatio)
-		crop = image.Rect((imgWidth-cropWidth)/2, 0, (imgWidth-cropWidth)/2+cropWidth, imgHeight)
+	// width and height are the size of the display, which may be mounted rotated
+	contentWidth, contentHeight := width, height
+	if options.Rotate == 90 || options.Rotate == 270 {
+		contentWidth, contentHeight = height, width
 	}
 
-	// then we resize it to the correct size
-	resized := image.NewRGBA(image.Rect(0, 0, width, height))
-
-	draw.CatmullRom.Scale(resized, resized.Bounds(), img, crop, draw.Over, nil)
-
-	bmp.Encode(*writer, resized)
-
-	return nil
+	resized := orient(fit(img, contentWidth, contentHeight, options), options)
+
+	switch options.Format {
+	case "", FormatBMP:
+		return bmp.Encode(*writer, resized)
+	case FormatMono:
+		return writeMono(*writer, resized, options)
+	case FormatGray2, FormatGray4:
+		return writeGray(*writer, resized, options)
+	default:
+		return writeRawPixels(*writer, resized, options.Format)
+	}
 }
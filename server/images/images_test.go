@@ -0,0 +1,21 @@
+package images
+
+import (
+	"image"
+	"image/color"
+)
+
+// newTestImage returns an opaque image with the given rows of pixels.
+func newTestImage(rows [][]color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, pixel := range row {
+			img.SetRGBA(x, y, pixel)
+		}
+	}
+	return img
+}
+
+func gray(value uint8) color.RGBA {
+	return color.RGBA{value, value, value, 255}
+}
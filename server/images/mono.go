@@ -0,0 +1,64 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+type MonoPacking string
+
+const (
+	// 8 horizontal pixels per byte with the leftmost in the highest bit, every
+	// row starts on a new byte
+	PackRows MonoPacking = "rows"
+	// 8 vertical pixels per byte with the topmost in the lowest bit, pages of 8
+	// rows from left to right, as SSD1306 and SH1106 controllers store them
+	PackPages MonoPacking = "pages"
+)
+
+func ParseMonoPacking(packingRaw string) (MonoPacking, error) {
+	packing := MonoPacking(packingRaw)
+	switch packing {
+	case "":
+		return PackRows, nil
+	case PackRows, PackPages:
+		return packing, nil
+	}
+	return "", fmt.Errorf("unknown packing %q", packingRaw)
+}
+
+// writeMono writes 1 bit per pixel where a set bit is a lit (white) pixel
+func writeMono(writer io.Writer, img *image.RGBA, options Options) error {
+	width, height := GetImageSize(img)
+	levels := quantize(luminance(img), width, height, 2, options.Dither, options.Threshold)
+
+	var packed []byte
+	switch options.Packing {
+	case PackPages:
+		pages := (height + 7) / 8
+		packed = make([]byte, pages*width)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if levels[y*width+x] != 0 {
+					packed[(y/8)*width+x] |= 1 << (y % 8)
+				}
+			}
+		}
+	case PackRows, "":
+		rowBytes := (width + 7) / 8
+		packed = make([]byte, rowBytes*height)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if levels[y*width+x] != 0 {
+					packed[y*rowBytes+x/8] |= 0x80 >> (x % 8)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown packing %q", options.Packing)
+	}
+
+	_, err := writer.Write(packed)
+	return err
+}
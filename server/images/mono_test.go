@@ -0,0 +1,66 @@
+package images
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+)
+
+func TestWriteMonoPacking(t *testing.T) {
+	black, white := gray(0), gray(255)
+	rows := [][]color.RGBA{}
+	for y := 0; y < 10; y++ {
+		rows = append(rows, []color.RGBA{black, black})
+	}
+	rows[0][0] = white
+	rows[9][1] = white
+	img := newTestImage(rows)
+
+	tests := []struct {
+		packing  MonoPacking
+		expected []byte
+	}{
+		// one byte per row, leftmost pixel in the highest bit
+		{PackRows, []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0x40}},
+		// two pages of 8 rows, topmost pixel in the lowest bit
+		{PackPages, []byte{0x01, 0x00, 0x00, 0x02}},
+	}
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		err := writeMono(&b, img, Options{Format: FormatMono, Dither: DitherThreshold, Packing: test.packing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), test.expected) {
+			t.Errorf("%s: expected % x, got % x", test.packing, test.expected, b.Bytes())
+		}
+	}
+}
+
+func TestQuantizeMonoDither(t *testing.T) {
+	// a flat 4x4 gray of 96 should light about 6 of the 16 pixels
+	flat := make([]float32, 16)
+	for i := range flat {
+		flat[i] = 96
+	}
+
+	tests := []struct {
+		dither    DitherMode
+		threshold int
+		expected  []uint8
+	}{
+		{DitherFloydSteinberg, 0, []uint8{0, 1, 0, 0, 0, 0, 1, 0, 1, 0, 1, 0, 0, 0, 1, 0}},
+		{DitherAtkinson, 0, []uint8{0, 0, 0, 0, 0, 1, 1, 0, 0, 0, 0, 1, 1, 0, 0, 1}},
+		{DitherBayer, 0, []uint8{0, 0, 0, 1, 1, 0, 1, 0, 0, 1, 0, 0, 1, 0, 1, 0}},
+		{DitherThreshold, 0, make([]uint8, 16)},
+		{DitherThreshold, 96, bytes.Repeat([]uint8{1}, 16)},
+	}
+
+	for _, test := range tests {
+		levels := quantize(flat, 4, 4, 2, test.dither, test.threshold)
+		if !bytes.Equal(levels, test.expected) {
+			t.Errorf("%s %d: expected %v, got %v", test.dither, test.threshold, test.expected, levels)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package images
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+type PixelFormat string
+
+const (
+	FormatBMP PixelFormat = "bmp"
+	// headerless 16 bit pixels, high byte first as ST7789 and ILI9341 expect over SPI
+	FormatRGB565BE PixelFormat = "rgb565be"
+	// headerless 16 bit pixels, low byte first for little endian framebuffers
+	FormatRGB565LE PixelFormat = "rgb565le"
+	FormatRGB888   PixelFormat = "rgb888"
+	FormatBGR888   PixelFormat = "bgr888"
+	// 1 bit per pixel, see Options.Dither and Options.Packing
+	FormatMono PixelFormat = "mono"
+	// 4 and 16 gray levels packed into 2 and 4 bits per pixel, see Options.NibbleOrder
+	FormatGray2 PixelFormat = "gray2"
+	FormatGray4 PixelFormat = "gray4"
+)
+
+func ParsePixelFormat(formatRaw string) (PixelFormat, error) {
+	format := PixelFormat(formatRaw)
+	switch format {
+	case "":
+		return FormatBMP, nil
+	case FormatBMP, FormatRGB565BE, FormatRGB565LE, FormatRGB888, FormatBGR888, FormatMono, FormatGray2, FormatGray4:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown pixel format %q", formatRaw)
+}
+
+func (format PixelFormat) ContentType() string {
+	if format == "" || format == FormatBMP {
+		return "image/bmp"
+	}
+	return "application/octet-stream"
+}
+
+// writeRawPixels writes the pixels row by row from the top left without any
+// header. Transparent pixels end up black since img is alpha premultiplied.
+func writeRawPixels(writer io.Writer, img *image.RGBA, format PixelFormat) error {
+	bounds := img.Bounds()
+
+	bytesPerPixel := 3
+	if format == FormatRGB565BE || format == FormatRGB565LE {
+		bytesPerPixel = 2
+	}
+
+	row := make([]byte, bounds.Dx()*bytesPerPixel)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pixels := img.Pix[img.PixOffset(bounds.Min.X, y):]
+
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b := pixels[x*4], pixels[x*4+1], pixels[x*4+2]
+			out := row[x*bytesPerPixel:]
+
+			switch format {
+			case FormatRGB565BE, FormatRGB565LE:
+				rgb565 := uint16(r>>3)<<11 | uint16(g>>2)<<5 | uint16(b>>3)
+				if format == FormatRGB565BE {
+					out[0], out[1] = byte(rgb565>>8), byte(rgb565)
+				} else {
+					out[0], out[1] = byte(rgb565), byte(rgb565>>8)
+				}
+			case FormatRGB888:
+				out[0], out[1], out[2] = r, g, b
+			case FormatBGR888:
+				out[0], out[1], out[2] = b, g, r
+			default:
+				return fmt.Errorf("unknown pixel format %q", format)
+			}
+		}
+
+		_, err := writer.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
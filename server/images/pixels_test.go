@@ -0,0 +1,33 @@
+package images
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+)
+
+func TestWriteRawPixels(t *testing.T) {
+	img := newTestImage([][]color.RGBA{
+		{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}},
+	})
+
+	tests := []struct {
+		format   PixelFormat
+		expected []byte
+	}{
+		{FormatRGB565BE, []byte{0xf8, 0x00, 0x07, 0xe0, 0x00, 0x1f}},
+		{FormatRGB565LE, []byte{0x00, 0xf8, 0xe0, 0x07, 0x1f, 0x00}},
+		{FormatRGB888, []byte{255, 0, 0, 0, 255, 0, 0, 0, 255}},
+		{FormatBGR888, []byte{0, 0, 255, 0, 255, 0, 255, 0, 0}},
+	}
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := writeRawPixels(&b, img, test.format); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), test.expected) {
+			t.Errorf("%s: expected % x, got % x", test.format, test.expected, b.Bytes())
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package images
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// the image is scored at this size, details smaller than that do not matter for the crop
+	SMART_CROP_ANALYSIS_SIZE = 64
+	// how much a crop at the very edge is penalized compared to a centered one,
+	// keeps the crop centered when nothing stands out
+	SMART_CROP_CENTER_BIAS = 0.1
+	// weight of color saturation compared to edges
+	SMART_CROP_SATURATION_WEIGHT = 0.5
+)
+
+// saliency scores every pixel of img by its edge strength and saturation, row by row
+func saliency(img *image.RGBA) []float64 {
+	width, height := GetImageSize(img)
+	gray := luminance(img)
+
+	at := func(x, y int) float64 {
+		x = min(max(x, 0), width-1)
+		y = min(max(y, 0), height-1)
+		return float64(gray[y*width+x])
+	}
+
+	scores := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		pixels := img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y):]
+		for x := 0; x < width; x++ {
+			edge := math.Abs(at(x+1, y)-at(x-1, y)) + math.Abs(at(x, y+1)-at(x, y-1))
+
+			r, g, b := pixels[x*4], pixels[x*4+1], pixels[x*4+2]
+			saturation := float64(max(r, g, b) - min(r, g, b))
+
+			scores[y*width+x] = edge + SMART_CROP_SATURATION_WEIGHT*saturation
+		}
+	}
+
+	return scores
+}
+
+// bestWindow returns the start of the window of the given length with the highest
+// sum of profile, slightly preferring windows near the center
+func bestWindow(profile []float64, window int) int {
+	prefix := make([]float64, len(profile)+1)
+	for i, value := range profile {
+		prefix[i+1] = prefix[i] + value
+	}
+
+	slack := len(profile) - window
+	center := float64(slack) / 2
+
+	best, bestScore := 0, math.Inf(-1)
+	for start := 0; start <= slack; start++ {
+		score := prefix[start+window] - prefix[start]
+		if center > 0 {
+			score *= 1 - SMART_CROP_CENTER_BIAS*math.Abs(float64(start)-center)/center
+		}
+		// ties go to the window closest to the center
+		if score > bestScore || (score == bestScore && math.Abs(float64(start)-center) < math.Abs(float64(best)-center)) {
+			best, bestScore = start, score
+		}
+	}
+
+	return best
+}
+
+// smartCropPosition picks where a cropWidth x cropHeight crop of img covers the most
+// salient region. Like Anchor.position it returns 0 (left/top) to 1 (right/bottom).
+// The result only depends on the pixels, so the same image always gets the same crop.
+func smartCropPosition(img image.Image, cropWidth, cropHeight int) (x, y float64) {
+	x, y = 0.5, 0.5
+
+	bounds := img.Bounds()
+	horizontal := cropWidth < bounds.Dx()
+	if !horizontal && cropHeight >= bounds.Dy() {
+		return x, y
+	}
+
+	scale := min(1, SMART_CROP_ANALYSIS_SIZE/float64(max(bounds.Dx(), bounds.Dy())))
+	analysisWidth := max(1, int(float64(bounds.Dx())*scale+0.5))
+	analysisHeight := max(1, int(float64(bounds.Dy())*scale+0.5))
+
+	small := image.NewRGBA(image.Rect(0, 0, analysisWidth, analysisHeight))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, bounds, draw.Src, nil)
+	scores := saliency(small)
+
+	// a cover crop only ever moves along one axis, so the scores are summed across the other
+	var profile []float64
+	var window int
+	if horizontal {
+		profile = make([]float64, analysisWidth)
+		for i, score := range scores {
+			profile[i%analysisWidth] += score
+		}
+		window = int(float64(cropWidth)*scale + 0.5)
+	} else {
+		profile = make([]float64, analysisHeight)
+		for i, score := range scores {
+			profile[i/analysisWidth] += score
+		}
+		window = int(float64(cropHeight)*scale + 0.5)
+	}
+	window = min(max(window, 1), len(profile))
+
+	slack := len(profile) - window
+	if slack == 0 {
+		return x, y
+	}
+
+	// nothing stands out, e.g. in a flat image, so keep the crop exactly centered
+	total := 0.0
+	for _, value := range profile {
+		total += value
+	}
+	if total == 0 {
+		return x, y
+	}
+
+	position := float64(bestWindow(profile, window)) / float64(slack)
+	if horizontal {
+		return position, y
+	}
+	return x, position
+}
@@ -0,0 +1,33 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSmartCrop(t *testing.T) {
+	// a flat gray 300x100 image with a red checkerboard right of the center
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			pixel := gray(128)
+			if x >= 220 && x < 280 && y >= 30 && y < 70 && (x/4+y/4)%2 == 0 {
+				pixel = color.RGBA{255, 0, 0, 255}
+			}
+			img.SetRGBA(x, y, pixel)
+		}
+	}
+
+	expected := image.Rect(181, 0, 281, 100)
+	if crop := coverCrop(img, 10, 10, AnchorSmart); crop != expected {
+		t.Errorf("expected %v, got %v", expected, crop)
+	}
+
+	// with nothing interesting the crop is the same as a centered one
+	flat := image.NewRGBA(image.Rect(0, 0, 100, 300))
+	expected = coverCrop(flat, 10, 10, AnchorCenter)
+	if crop := coverCrop(flat, 10, 10, AnchorSmart); crop != expected {
+		t.Errorf("expected %v, got %v", expected, crop)
+	}
+}
@@ -9,9 +9,12 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/plugins/migratecmd"
+	"github.com/spf13/cobra"
 
 	keyboard_apis "keyboard-api/apis"
 	"keyboard-api/apis/weather"
+	// registers the migrations in ./migrations, pocketbase applies them on serve
+	_ "keyboard-api/migrations"
 
 	_ "github.com/joho/godotenv/autoload"
 )
@@ -28,14 +31,50 @@ func main() {
 		Automigrate: isGoRun,
 	})
 
+	// after rotating CREDENTIALS_KEY (with the old key moved to CREDENTIALS_PREVIOUS_KEYS)
+	// this re-encrypts all stored credentials so the old key can be dropped
+	app.RootCmd.AddCommand(&cobra.Command{
+		Use:   "rotate-credentials-key",
+		Short: "Re-encrypts the stored spotify credentials with the current CREDENTIALS_KEY",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			count, err := keyboard_apis.ReencryptSpotifyCredentials(app.Dao())
+			if err != nil {
+				return err
+			}
+			log.Printf("Re-encrypted spotify credentials of %d users\n", count)
+			return nil
+		},
+	})
+
+	spotify := keyboard_apis.NewSpotifyClient()
+
 	// serves static files from the provided public dir (if exists)
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		e.Router.GET("/*", apis.StaticDirectoryHandler(os.DirFS("./pb_public"), false))
 
-		e.Router.GET("/spotify/loginUrl", keyboard_apis.SpotifyLoginUrlHandler)
-		e.Router.GET("/spotify/callback", keyboard_apis.SpotifyCallbackHandler(app))
-		e.Router.GET("/spotify/currently-playing", keyboard_apis.SpotifyCurrentlyPlayingHandler(app))
-		e.Router.GET("/spotify/currently-playing-art", keyboard_apis.SpotifyCurrentlyPlayingArtHandler(app))
+		e.Router.GET("/spotify/loginUrl", keyboard_apis.SpotifyLoginUrlHandler(spotify))
+		e.Router.GET("/spotify/callback", keyboard_apis.SpotifyCallbackHandler(app, spotify))
+		e.Router.GET("/spotify/status", keyboard_apis.SpotifyStatusHandler(app, spotify))
+		e.Router.POST("/spotify/disconnect", keyboard_apis.SpotifyDisconnectHandler(app, spotify))
+		e.Router.GET("/spotify/currently-playing", keyboard_apis.SpotifyCurrentlyPlayingHandler(app, spotify))
+		e.Router.GET("/spotify/stream", keyboard_apis.SpotifyStreamHandler(app, spotify))
+		e.Router.GET("/spotify/currently-playing-art", keyboard_apis.SpotifyCurrentlyPlayingArtHandler(app, spotify))
+		e.Router.POST("/spotify/player/play-pause", keyboard_apis.SpotifyPlayPauseHandler(app, spotify))
+		e.Router.POST("/spotify/player/next", keyboard_apis.SpotifyNextHandler(app, spotify))
+		e.Router.POST("/spotify/player/previous", keyboard_apis.SpotifyPreviousHandler(app, spotify))
+		e.Router.POST("/spotify/player/seek", keyboard_apis.SpotifySeekHandler(app, spotify))
+		e.Router.POST("/spotify/player/shuffle", keyboard_apis.SpotifyToggleShuffleHandler(app, spotify))
+		e.Router.POST("/spotify/player/repeat", keyboard_apis.SpotifyCycleRepeatHandler(app, spotify))
+		e.Router.POST("/spotify/volume", keyboard_apis.SpotifyVolumeHandler(app, spotify))
+		e.Router.GET("/spotify/queue", keyboard_apis.SpotifyQueueHandler(app, spotify))
+		e.Router.POST("/spotify/queue/add", keyboard_apis.SpotifyAddToQueueHandler(app, spotify))
+		e.Router.GET("/spotify/recently-played", keyboard_apis.SpotifyRecentlyPlayedHandler(app, spotify))
+		e.Router.GET("/spotify/search", keyboard_apis.SpotifySearchHandler(app, spotify))
+		e.Router.POST("/spotify/search/play", keyboard_apis.SpotifyPlaySearchResultHandler(app, spotify))
+		e.Router.GET("/spotify/devices", keyboard_apis.SpotifyDevicesHandler(app, spotify))
+		e.Router.POST("/spotify/devices/transfer", keyboard_apis.SpotifyTransferHandler(app, spotify))
+		e.Router.POST("/spotify/slots/:n/play", keyboard_apis.SpotifyPlaySlotHandler(app, spotify))
+		e.Router.POST("/spotify/saved/toggle", keyboard_apis.SpotifyToggleSavedHandler(app, spotify))
 
 		e.Router.GET("/weather/current", weather.CurrentWeatherHandler(app))
 		e.Router.GET("/weather/hourly", weather.HourlyWeatherHandler(app))
@@ -94,7 +94,9 @@ func init() {
 			return err
 		}
 
-		return daos.New(db).ImportCollections(collections, true, nil)
+		// deleteMissing is off so deployments that ran without migrations keep
+		// their other collections and any fields added to users
+		return daos.New(db).ImportCollections(collections, false, nil)
 	}, func(db dbx.Builder) error {
 		return nil
 	})
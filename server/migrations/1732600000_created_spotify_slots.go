@@ -0,0 +1,118 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		jsonData := `{
+			"id": "q8w2k1fzt0m3slt",
+			"created": "2024-11-26 05:46:40.000Z",
+			"updated": "2024-11-26 05:46:40.000Z",
+			"name": "spotify_slots",
+			"type": "base",
+			"system": false,
+			"schema": [
+				{
+					"system": false,
+					"id": "slotuser",
+					"name": "user",
+					"type": "relation",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"collectionId": "_pb_users_auth_",
+						"cascadeDelete": true,
+						"minSelect": null,
+						"maxSelect": 1,
+						"displayFields": null
+					}
+				},
+				{
+					"system": false,
+					"id": "slotnumb",
+					"name": "slot",
+					"type": "number",
+					"required": true,
+					"presentable": true,
+					"unique": false,
+					"options": {
+						"min": 1,
+						"max": null,
+						"noDecimal": true
+					}
+				},
+				{
+					"system": false,
+					"id": "slotname",
+					"name": "name",
+					"type": "text",
+					"required": false,
+					"presentable": true,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": 100,
+						"pattern": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "slotctxu",
+					"name": "context_uri",
+					"type": "text",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": null,
+						"pattern": "^spotify:(playlist|album|artist):[A-Za-z0-9]+$"
+					}
+				},
+				{
+					"system": false,
+					"id": "slotshuf",
+					"name": "shuffle",
+					"type": "bool",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {}
+				}
+			],
+			"indexes": [
+				"CREATE UNIQUE INDEX ` + "`" + `idx_spotify_slots_user_slot` + "`" + ` ON ` + "`" + `spotify_slots` + "`" + ` (\n  ` + "`" + `user` + "`" + `,\n  ` + "`" + `slot` + "`" + `\n)"
+			],
+			"listRule": "user = @request.auth.id",
+			"viewRule": "user = @request.auth.id",
+			"createRule": "@request.auth.id != \"\" && user = @request.auth.id",
+			"updateRule": "user = @request.auth.id && (@request.data.user:isset = false || @request.data.user = @request.auth.id)",
+			"deleteRule": "user = @request.auth.id",
+			"options": {}
+		}`
+
+		collection := &models.Collection{}
+		if err := json.Unmarshal([]byte(jsonData), &collection); err != nil {
+			return err
+		}
+
+		return daos.New(db).SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("spotify_slots")
+		if err != nil {
+			return err
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
@@ -0,0 +1,112 @@
+package migrations
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"keyboard-api/secrets"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Encrypts the spotify credentials that were stored in plain text before. The
+// plain text json is sealed as is, into the {"encrypted": ...} shape the apis
+// package reads. Reverting decrypts them again, which needs the same keys.
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		users, err := dao.FindRecordsByExpr("users")
+		if err != nil {
+			return err
+		}
+
+		var keyring *secrets.Keyring
+		for _, user := range users {
+			raw, _ := user.Get("spotify").(types.JsonRaw)
+			if len(raw) == 0 || string(raw) == "null" {
+				continue
+			}
+
+			var stored map[string]json.RawMessage
+			err = json.Unmarshal(raw, &stored)
+			if err != nil {
+				return err
+			}
+			if _, ok := stored["encrypted"]; ok || len(stored) == 0 {
+				continue
+			}
+
+			if keyring == nil {
+				keyring, err = secrets.KeyringFromEnv()
+				if err != nil {
+					return err
+				}
+			}
+
+			sealed, err := keyring.Encrypt(raw)
+			if err != nil {
+				return fmt.Errorf("encrypting the spotify credentials of user %s: %w", user.Id, err)
+			}
+
+			user.Set("spotify", map[string]any{
+				"encrypted": sealed,
+			})
+			err = dao.SaveRecord(user)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		users, err := dao.FindRecordsByExpr("users")
+		if err != nil {
+			return err
+		}
+
+		var keyring *secrets.Keyring
+		for _, user := range users {
+			raw, _ := user.Get("spotify").(types.JsonRaw)
+			if len(raw) == 0 || string(raw) == "null" {
+				continue
+			}
+
+			var stored struct {
+				Encrypted *secrets.Sealed `json:"encrypted"`
+			}
+			err = json.Unmarshal(raw, &stored)
+			if err != nil {
+				return err
+			}
+			if stored.Encrypted == nil {
+				continue
+			}
+
+			if keyring == nil {
+				keyring, err = secrets.KeyringFromEnv()
+				if err != nil {
+					return err
+				}
+			}
+
+			plaintext, err := keyring.Decrypt(*stored.Encrypted)
+			if err != nil {
+				return fmt.Errorf("decrypting the spotify credentials of user %s: %w", user.Id, err)
+			}
+
+			user.Set("spotify", types.JsonRaw(plaintext))
+			err = dao.SaveRecord(user)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
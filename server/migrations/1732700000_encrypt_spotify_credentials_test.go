@@ -0,0 +1,83 @@
+package migrations_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	_ "keyboard-api/migrations"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func TestEncryptSpotifyCredentialsRoundTrip(t *testing.T) {
+	t.Setenv("CREDENTIALS_KEY", "test-credentials-key")
+
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir()})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+
+	runner, err := migrate.NewRunner(app.DB(), migrations.AppMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.NewRecord(collection)
+	user.SetUsername("test_user")
+	user.SetEmail("test@example.com")
+	user.SetPassword("1234567890")
+	user.Set("spotify", map[string]any{"access_token": "access", "refresh_token": "refresh"})
+	if err := app.Dao().SaveRecord(user); err != nil {
+		t.Fatal(err)
+	}
+
+	// run the encryption again, now that there is a plain text record
+	if _, err := runner.Down(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := readSpotifyField(t, app, user.Id)
+	if _, ok := stored["encrypted"]; !ok || stored["access_token"] != nil {
+		t.Fatalf("expected encrypted credentials, got %v", stored)
+	}
+
+	if _, err := runner.Down(1); err != nil {
+		t.Fatal(err)
+	}
+
+	stored = readSpotifyField(t, app, user.Id)
+	if stored["access_token"] != "access" || stored["refresh_token"] != "refresh" || stored["encrypted"] != nil {
+		t.Fatalf("expected the plain text credentials back, got %v", stored)
+	}
+}
+
+func readSpotifyField(t *testing.T, app *pocketbase.PocketBase, userId string) map[string]any {
+	t.Helper()
+
+	user, err := app.Dao().FindRecordById("users", userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := user.Get("spotify").(types.JsonRaw)
+
+	var stored map[string]any
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
@@ -0,0 +1,144 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNoKey      = errors.New("CREDENTIALS_KEY is not configured")
+	ErrUnknownKey = errors.New("secret was encrypted with an unknown key")
+)
+
+// Sealed is an AES-GCM encrypted value along with the id of the key that
+// encrypted it, so it can still be opened after the current key is rotated.
+type Sealed struct {
+	KeyId      string `json:"key_id"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newKey(secret string) (*key, error) {
+	// the configured secret can be any string, derive a 256 bit key from it
+	keyBytes := sha256.Sum256([]byte(secret))
+	idBytes := sha256.Sum256([]byte("key-id:" + secret))
+
+	block, err := aes.NewCipher(keyBytes[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key{
+		id:   hex.EncodeToString(idBytes[:4]),
+		aead: aead,
+	}, nil
+}
+
+// Keyring encrypts with the current key and decrypts with the current key or
+// any of the previous ones.
+type Keyring struct {
+	current *key
+	keys    map[string]*key
+}
+
+func NewKeyring(currentSecret string, previousSecrets ...string) (*Keyring, error) {
+	keyring := &Keyring{
+		keys: map[string]*key{},
+	}
+
+	for _, secret := range previousSecrets {
+		if secret == "" {
+			continue
+		}
+		previous, err := newKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[previous.id] = previous
+	}
+
+	if currentSecret != "" {
+		current, err := newKey(currentSecret)
+		if err != nil {
+			return nil, err
+		}
+		keyring.current = current
+		keyring.keys[current.id] = current
+	}
+
+	return keyring, nil
+}
+
+// KeyringFromEnv builds a keyring from CREDENTIALS_KEY and the comma separated
+// CREDENTIALS_PREVIOUS_KEYS.
+func KeyringFromEnv() (*Keyring, error) {
+	previousSecrets := strings.Split(os.Getenv("CREDENTIALS_PREVIOUS_KEYS"), ",")
+	return NewKeyring(os.Getenv("CREDENTIALS_KEY"), previousSecrets...)
+}
+
+func (keyring *Keyring) Encrypt(plaintext []byte) (sealed Sealed, err error) {
+	if keyring.current == nil {
+		return sealed, ErrNoKey
+	}
+
+	nonce := make([]byte, keyring.current.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return sealed, err
+	}
+
+	ciphertext := keyring.current.aead.Seal(nil, nonce, plaintext, []byte(keyring.current.id))
+
+	return Sealed{
+		KeyId:      keyring.current.id,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}, nil
+}
+
+func (keyring *Keyring) Decrypt(sealed Sealed) ([]byte, error) {
+	key, ok := keyring.keys[sealed.KeyId]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(sealed.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != key.aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+
+	return key.aead.Open(nil, nonce, ciphertext, []byte(key.id))
+}
+
+// CanEncrypt reports whether a current key is configured.
+func (keyring *Keyring) CanEncrypt() bool {
+	return keyring.current != nil
+}
+
+// IsCurrent reports whether sealed was encrypted with the current key.
+func (keyring *Keyring) IsCurrent(sealed Sealed) bool {
+	return keyring.current != nil && sealed.KeyId == keyring.current.id
+}